@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+type allergenRequest struct {
+	Type     string   `json:"type"`
+	Synonyms []string `json:"synonyms"`
+}
+
+// GetAllergens lists the allergen vocabulary with its synonyms and usage
+func GetAllergens(c *gin.Context) {
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	allergens, err := utils.ListAllergens(ctx, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"allergens": allergens})
+}
+
+// CreateAllergen adds an allergen and its synonyms to the vocabulary
+func CreateAllergen(c *gin.Context) {
+	var request allergenRequest
+	if err := c.ShouldBindJSON(&request); err != nil || strings.TrimSpace(request.Type) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type is required"})
+		return
+	}
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	allergen, conflict, err := utils.CreateAllergen(ctx, session, request.Type, request.Synonyms)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if conflict != "" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Already known as allergen %q", conflict)})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"allergen": allergen})
+}
+
+// UpdateAllergen renames the allergen :key, when type is given, and replaces
+// its synonyms
+func UpdateAllergen(c *gin.Context) {
+	var request allergenRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	allergen, found, conflict, err := utils.UpdateAllergen(ctx, session, utils.ReferenceKey(c.Param("key")), request.Type, request.Synonyms)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Allergen not found"})
+		return
+	}
+	if conflict != "" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Already known as allergen %q", conflict)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"allergen": allergen})
+}
+
+// MergeAllergens folds the allergens listed in from into the allergen :key,
+// relinking their products and users and keeping their names as synonyms
+func MergeAllergens(c *gin.Context) {
+	var request struct {
+		From []string `json:"from"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || len(request.From) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from is required"})
+		return
+	}
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	allergen, found, err := utils.MergeAllergens(ctx, session, utils.ReferenceKey(c.Param("key")), request.From)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Allergen not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"allergen": allergen})
+}
+
+// DeleteAllergen removes the allergen :key once no product or user has it
+func DeleteAllergen(c *gin.Context) {
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	key := utils.ReferenceKey(c.Param("key"))
+	found, inUse, err := utils.DeleteAllergen(ctx, session, key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Allergen not found"})
+		return
+	}
+	if inUse {
+		c.JSON(http.StatusConflict, gin.H{"error": "Allergen is in use, merge it into another allergen instead"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Allergen %s deleted", key)})
+}
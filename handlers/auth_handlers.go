@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
 	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
@@ -102,13 +103,22 @@ func AdminAuthentication(c *gin.Context) {
 
 func GenerateSite(c *gin.Context) {
 	var data struct {
-		Title   string `json:"title"`
-		SiteUrl string `json:"site_url"`
+		Title          string `json:"title"`
+		SiteUrl        string `json:"site_url"`
+		WooCommerceUrl string `json:"woocommerce_url"`
+		ConsumerKey    string `json:"consumer_key"`
+		ConsumerSecret string `json:"consumer_secret"`
+		Currency       string `json:"currency"`
 	}
 	if err := c.ShouldBindJSON(&data); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
 		return
 	}
+	currency, err := types.ParseCurrency(data.Currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	secretID, err := utils.GenerateRandomHex(16)
 	if err != nil {
@@ -133,16 +143,20 @@ func GenerateSite(c *gin.Context) {
 	defer session.Close(ctx)
 	query :=
 		`
-    MATCH(i:Index {name: "site_index"})
-    SET i.value = i.value + 1
-    CREATE(s:Site {id: i.value, name: $name, secretID: $secretID,
-    secret: $secret, url: $siteUrl }) return s.id as id, s.name as name, s.secretID as secretID, s.secret as secret, s.siteUrl as url
+    CREATE(s:Site {id: $id, name: $name, secretID: $secretID,
+    secret: $secret, url: $siteUrl, woocommerce_url: $woocommerceUrl,
+    consumer_key: $consumerKey, consumer_secret: $consumerSecret, currency: $currency }) return s.id as id, s.name as name, s.secretID as secretID, s.secret as secret, s.siteUrl as url, s.woocommerce_url as woocommerce_url, s.currency as currency
     `
 	params := map[string]interface{}{
-		"name":     data.Title,
-		"siteUrl":  data.SiteUrl,
-		"secretID": secretID,
-		"secret":   secret,
+		"id":             utils.NewID(),
+		"name":           data.Title,
+		"siteUrl":        data.SiteUrl,
+		"secretID":       secretID,
+		"secret":         secret,
+		"woocommerceUrl": data.WooCommerceUrl,
+		"consumerKey":    data.ConsumerKey,
+		"consumerSecret": data.ConsumerSecret,
+		"currency":       currency,
 	}
 	results, _ := session.ExecuteWrite(ctx,
 		func(tx neo4j.ManagedTransaction) (any, error) {
@@ -158,6 +172,74 @@ func GenerateSite(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"results": secrets})
 }
 
+// UpdateSiteWooCommerce sets the WooCommerce store URL and REST credentials
+// used to sync the catalog of a site, and the currency of its prices when given
+func UpdateSiteWooCommerce(c *gin.Context) {
+	var data struct {
+		SecretID       string `json:"secret_id"`
+		Secret         string `json:"secret"`
+		WooCommerceUrl string `json:"woocommerce_url"`
+		ConsumerKey    string `json:"consumer_key"`
+		ConsumerSecret string `json:"consumer_secret"`
+		Currency       string `json:"currency"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil || data.WooCommerceUrl == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+	var currency any
+	if data.Currency != "" {
+		code, err := types.ParseCurrency(data.Currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		currency = code
+	}
+
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	query := `
+    MATCH (s:Site {secretID: $secretID, secret: $secret})
+    SET s.woocommerce_url = $woocommerceUrl, s.consumer_key = $consumerKey, s.consumer_secret = $consumerSecret,
+        s.currency = coalesce($currency, s.currency)
+    RETURN s.id AS id, s.woocommerce_url AS woocommerce_url, s.currency AS currency
+    `
+	params := map[string]interface{}{
+		"secretID":       data.SecretID,
+		"secret":         data.Secret,
+		"woocommerceUrl": data.WooCommerceUrl,
+		"consumerKey":    data.ConsumerKey,
+		"consumerSecret": data.ConsumerSecret,
+		"currency":       currency,
+	}
+	result, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid site credentials"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"site": records[0].AsMap()})
+}
+
 func GetSecrets(c *gin.Context) {
 	ctx := context.Background()
 	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
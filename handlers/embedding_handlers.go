@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+func GetEmbeddingCacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"cache": utils.GetEmbeddingCache().Stats()})
+}
+
+func PurgeEmbeddingCache(c *gin.Context) {
+	purged, err := utils.GetEmbeddingCache().Purge()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
+
+func StartReembedJob(c *gin.Context) {
+	job, err := utils.StartReembedJob()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"job": job})
+}
+
+func GetReembedJob(c *gin.Context) {
+	job, found, err := utils.GetReembedJob(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Re-embed job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+func SwitchEmbeddingTarget(c *gin.Context) {
+	var request struct {
+		Force bool `json:"force"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	target, conflict, err := utils.SwitchEmbeddingTarget(ctx, session, request.Force)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if conflict != "" {
+		c.JSON(http.StatusConflict, gin.H{"error": conflict})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"active": target})
+}
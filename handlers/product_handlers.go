@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
@@ -16,10 +16,24 @@ import (
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 )
 
+// AddProduct creates a curated product, embedding it and linking it to its
+// Allergens, Gender and Affiliations
 func AddProduct(c *gin.Context) {
+	saveProduct(c, "")
+}
+
+// EditProduct replaces the curated fields of the product :id
+func EditProduct(c *gin.Context) {
+	saveProduct(c, c.Param("id"))
+}
+
+func saveProduct(c *gin.Context, id string) {
 	var product types.Product
-	err := json.NewDecoder(c.Request.Body).Decode(&product)
-	if err != nil {
+	if err := json.NewDecoder(c.Request.Body).Decode(&product); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := utils.ValidateProduct(&product); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -32,39 +46,63 @@ func AddProduct(c *gin.Context) {
 	defer driver.Close(ctx)
 	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
 	defer session.Close(ctx)
-	query := `MATCH(i:Index {name: "product_index"})
-        SET i.value = i.value + 1
-        CREATE(p:Product {id: i.value, name: $name, description: $description, price: $price}),
-        (p)-[:HAS_ALLERGY]->(a:Allergens {type: $allergens}),
-        (p)-[:GENDER]->(g:Gender {type: $gender}) set p.textEmbedding = $embeddings
-        return p.id as id`
-	params := map[string]interface{}{
-		"name":        product.Name,
-		"description": product.Description,
-		"price":       product.Price,
-		"allergens":   product.Allergens,
-		"gender":      product.Gender,
+	missing, err := utils.MissingAffiliations(ctx, session, product.AffiliationIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	results, _ := session.ExecuteWrite(ctx,
-		func(tx neo4j.ManagedTransaction) (any, error) {
-			result, _ := tx.Run(ctx, query, params)
-			records, _ := result.Collect(ctx)
-			return records, nil
-		})
-	var products []map[string]any
-	for _, p := range results.([]*neo4j.Record) {
-		products = append(products, p.AsMap())
+	if len(missing) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown affiliations %v", missing)})
+		return
+	}
+	productID, found, err := utils.SaveAdminProduct(ctx, session, id, product)
+	if err != nil {
+		log.Printf("Error saving product: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save product"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	saved, _, err := utils.GetProduct(ctx, session, productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	c.JSON(http.StatusCreated, gin.H{"results": products})
+	status := http.StatusOK
+	if id == "" {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"product": saved})
 }
 
-func EditProduct(c *gin.Context) {
-	var product types.Product
-	err := json.NewDecoder(c.Request.Body).Decode(&product)
+// GetProduct returns the product :id, including soft deleted ones
+func GetProduct(c *gin.Context) {
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	product, found, err := utils.GetProduct(ctx, session, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"product": product})
+}
+
+// DeleteProduct soft deletes the product :id, which is purged after
+// PRODUCT_RETENTION
+func DeleteProduct(c *gin.Context) {
 	ctx := context.Background()
 	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
 	if err != nil {
@@ -74,32 +112,22 @@ func EditProduct(c *gin.Context) {
 	defer driver.Close(ctx)
 	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
 	defer session.Close(ctx)
-	query := `MATCH (p:Product {id: $id}), (p)-->(a:Allergens), (p)-->(g:Gender)
-        SET p.name = $name, p.description = $description, p.price = $price,
-        p.textEmbedding = $embeddings,
-        a.type = $allergens, g.type = $gender
-        return distinct p.id as id`
-	params := map[string]interface{}{
-		"id":          product.ID,
-		"name":        product.Name,
-		"description": product.Description,
-		"price":       product.Price,
-		"allergens":   product.Allergens,
-		"gender":      product.Gender,
+	found, err := utils.DeleteProduct(ctx, session, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	results, _ := session.ExecuteWrite(ctx,
-		func(tx neo4j.ManagedTransaction) (any, error) {
-			result, _ := tx.Run(ctx, query, params)
-			records, _ := result.Collect(ctx)
-			return records, nil
-		})
-	var products []map[string]any
-	for _, p := range results.([]*neo4j.Record) {
-		products = append(products, p.AsMap())
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
 	}
-	c.JSON(http.StatusOK, gin.H{"results": products})
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Product %s deleted", c.Param("id"))})
 }
 
+// GetRecommendations returns the products of an affiliation nearest to a
+// query, leaving out those containing any of the patient's allergies or meant
+// for another gender. Patients missing from the graph are loaded from Postgres
+// by their IC/passport number
 func GetRecommendations(c *gin.Context) {
 	var recquery types.RecommendationQuery
 	err := json.NewDecoder(c.Request.Body).Decode(&recquery)
@@ -107,13 +135,19 @@ func GetRecommendations(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	isuserexist := utils.CheckIfUserExistsInNeo4J(recquery.UserIc)
-	if !isuserexist {
-		data := utils.GetUserDataFromPgV2(recquery.UserIc)
-		result := utils.StoreUserData(data)
-		fmt.Println(result)
+	if recquery.UserIc == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_ic is required"})
+		return
+	}
+	if !utils.CheckIfUserExistsInNeo4J(recquery.UserIc) {
+		data, err := utils.GetUserDataFromPgByIc(recquery.UserIc)
+		if err != nil {
+			log.Printf("Error loading user %s: %s", recquery.UserIc, err.Error())
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		utils.StoreUserData(data)
 	}
-	queryVector := utils.GetEmbeddings(recquery.Query)
 	ctx := context.Background()
 	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
 	if err != nil {
@@ -123,44 +157,76 @@ func GetRecommendations(c *gin.Context) {
 	defer driver.Close(ctx)
 	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
 	defer session.Close(ctx)
-	query :=
+	user, err := utils.ResolveUser(ctx, session, recquery.UserIc, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	queryVector, target, err := utils.GetQueryEmbeddings(ctx, session, recquery.Query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	query := utils.ProductVectorSearchCypher(target) +
 		`
-    CALL db.index.vector.queryNodes('product_text_embeddings', $limit, $queryVector)
-    YIELD node AS product, score
-    WHERE score > 0.65
-    MATCH (product)-[:HAS_ALLERGY]->(a:Allergens),
-          (product)-[:GENDER]->(g:Gender),
-          (product)-[:IS_AFFILIATED_WITH]->(af:Affiliations),
-          (u:User {id: $userId})-[:HAS_ALLERGY]->(userAllergen:Allergens),
-          (u)-[:GENDER]->(userGender:Gender)
-    WHERE (a.type = "Not-Known" OR a.type <> userAllergen)
-          AND (g.type = userGender  OR g.type = "Unisex")
-          AND af.id = $affiliationID
-    RETURN product.name AS name, product.description AS description, product.price AS price, score
+    WHERE score > 0.65 AND coalesce(product.active, true)
+          AND EXISTS { (product)-[:IS_AFFILIATED_WITH]->(:Affiliations {id: $affiliationID}) }
+          // Not-Known is never one of the user's allergies, so it never excludes a product
+          AND NOT EXISTS { (product)-[:HAS_ALLERGY]->(a:Allergens) WHERE a.key IN $userAllergens }
+          AND ($userGender = "" OR NOT EXISTS {
+              (product)-[:GENDER]->(g:Gender) WHERE g.key <> "unisex" AND g.key <> toLower($userGender)
+          })
+    RETURN product.name AS name, product.description AS description, product.price AS price,
+           product.currency AS currency,
+           COLLECT { MATCH (product)-[:HAS_ALLERGY]->(a:Allergens) RETURN a.type } AS allergens,
+           COLLECT { MATCH (product)-[:GENDER]->(g:Gender) RETURN g.type }[0] AS gender,
+           score
+    ORDER BY score DESC
     `
 	params := map[string]interface{}{
 		"limit":         recquery.Limit,
 		"queryVector":   queryVector,
-		"userId":        recquery.UserIc,
 		"affiliationID": recquery.AffiliationID,
+		"userAllergens": user.AllergenKeys,
+		"userGender":    user.Gender,
 	}
-	results, _ := session.ExecuteWrite(ctx,
+	results, err := session.ExecuteRead(ctx,
 		func(tx neo4j.ManagedTransaction) (any, error) {
-			result, _ := tx.Run(ctx, query, params)
-			records, _ := result.Collect(ctx)
-			return records, nil
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
 		})
-	var recommendations []map[string]any
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recommendations := []map[string]any{}
 	for _, p := range results.([]*neo4j.Record) {
-		recommendations = append(recommendations, p.AsMap())
+		recommendation := p.AsMap()
+		utils.FormatPrices(recommendation)
+		recommendations = append(recommendations, recommendation)
 	}
 	c.JSON(http.StatusOK, gin.H{"recommendations": recommendations})
 }
 
+// GetProducts lists active products a page at a time. ?limit= (default 20),
+// ?sort= and ?cursor= page through them and site_id, category, min_price,
+// max_price, currency, allergen_free, gender, stock_status and affiliation
+// filter them
 func GetProducts(c *gin.Context) {
+	query, err := productListQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	ctx := context.Background()
 	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
-	log.Println(driver)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -168,24 +234,159 @@ func GetProducts(c *gin.Context) {
 	defer driver.Close(ctx)
 	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
 	defer session.Close(ctx)
-	query :=
-		`
-    MATCH (p:Product), (p)-->(a:Allergens), (p)-->(g:Gender)
-    RETURN distinct p.id as id, p.name as name,p.description as description,p.price as
-    price, a.type as allergens, g.type as gender order by p.id DESC
-    `
-	params := map[string]interface{}{}
-	results, _ := session.ExecuteWrite(ctx,
-		func(tx neo4j.ManagedTransaction) (any, error) {
-			result, _ := tx.Run(ctx, query, params)
-			records, _ := result.Collect(ctx)
-			return records, nil
-		})
-	var products []map[string]any
-	for _, p := range results.([]*neo4j.Record) {
-		products = append(products, p.AsMap())
+	page, err := utils.ListProducts(ctx, session, query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	response := gin.H{"products": page.Products, "total": page.Total, "limit": query.Limit, "sort": query.Sort}
+	if page.NextCursor != "" {
+		next := c.Request.URL.Query()
+		next.Set("cursor", page.NextCursor)
+		response["next_cursor"] = page.NextCursor
+		response["next"] = c.Request.URL.Path + "?" + next.Encode()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func productListQuery(c *gin.Context) (types.ProductListQuery, error) {
+	query := types.ProductListQuery{
+		Sort:        c.Query("sort"),
+		Cursor:      c.Query("cursor"),
+		SiteID:      c.Query("site_id"),
+		StockStatus: c.Query("stock_status"),
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 || limit > 100 {
+		return query, fmt.Errorf("limit must be between 1 and 100")
+	}
+	query.Limit = limit
+	query.Categories = queryList(c, "category")
+	query.AllergenFree = queryList(c, "allergen_free")
+	if gender := c.Query("gender"); gender != "" {
+		if query.Gender, err = utils.ParseGender(gender); err != nil {
+			return query, err
+		}
+	}
+	if query.MinPrice, query.MaxPrice, err = queryPriceRange(c); err != nil {
+		return query, err
+	}
+	if value := c.Query("affiliation"); value != "" {
+		affiliation, err := strconv.Atoi(value)
+		if err != nil {
+			return query, fmt.Errorf("affiliation must be an affiliation id")
+		}
+		query.Affiliation = &affiliation
+	}
+	return query, utils.ValidateProductListQuery(&query)
+}
+
+// queryPriceRange returns ?min_price= and ?max_price= in ?currency= (default
+// types.DefaultCurrency), nil when missing
+func queryPriceRange(c *gin.Context) (*types.Money, *types.Money, error) {
+	currency, err := types.ParseCurrency(c.DefaultQuery("currency", types.DefaultCurrency))
+	if err != nil {
+		return nil, nil, err
+	}
+	minPrice, err := types.ParseMoney(c.Query("min_price"), currency)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid min_price: %w", err)
+	}
+	maxPrice, err := types.ParseMoney(c.Query("max_price"), currency)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid max_price: %w", err)
+	}
+	return minPrice, maxPrice, nil
+}
+
+// queryList returns the values of a query parameter given repeatedly or
+// comma separated
+func queryList(c *gin.Context, key string) []string {
+	values := []string{}
+	for _, value := range c.QueryArray(key) {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+	return values
+}
+
+// GetProductDetail returns the active product :id with its categories, tags,
+// attributes, variations, allergens, gender and affiliations
+func GetProductDetail(c *gin.Context) {
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	product, found, err := utils.GetProductDetail(ctx, session, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"product": product})
+}
+
+// GetSimilarProducts returns the products of the same site nearest to the
+// product :id. ?limit= (default 10) and category, tag, attribute (name:option),
+// in_stock, on_sale, min_price, max_price and currency narrow them
+func GetSimilarProducts(c *gin.Context) {
+	query := types.SimilarProductsQuery{
+		Categories: queryList(c, "category"),
+		Tags:       queryList(c, "tag"),
+		Attributes: c.QueryArray("attribute"),
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 || limit > 50 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 50"})
+		return
+	}
+	query.Limit = limit
+	for key, value := range map[string]*bool{"in_stock": &query.InStock, "on_sale": &query.OnSale} {
+		if *value, err = strconv.ParseBool(c.DefaultQuery(key, "false")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": key + " must be true or false"})
+			return
+		}
+	}
+	for _, attribute := range query.Attributes {
+		if _, err := utils.ParseAttributeFilter(attribute); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if query.MinPrice, query.MaxPrice, err = queryPriceRange(c); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	similar, found, err := utils.GetSimilarProducts(ctx, session, c.Param("id"), query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	c.JSON(http.StatusOK, gin.H{"products": products})
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"product_id": c.Param("id"), "similar": similar})
 }
 
 func StoreProductTransactions(c *gin.Context) {
@@ -209,7 +410,7 @@ func StoreProductTransactions(c *gin.Context) {
 		`
     UNWIND $product_transactions AS pt
       MATCH(u:User {id: $user_id})
-      MATCH(p:Product {id: pt.product_id})
+      MATCH(p:Product) WHERE p.id = pt.product_id OR p.legacy_id = pt.product_id
       MERGE (u)-[t:TRANSACTED]->(p)
       set t.order_id = $order_id, t.quantity = pt.quantity
       RETURN p.id, t.order_id, t.quantity,  u.id
@@ -264,37 +465,13 @@ func GetAffiliations(c *gin.Context) {
 func StoreWooCommerceProducts(c *gin.Context) {
 	ctx := context.Background()
 
-	// 1. Fetch products from WooCommerce API
-	baseUrl := os.Getenv("WOOCOMMERCE_PRODUCT_API")
-	consumerKey := os.Getenv("WOOCOMMERCE_CONSUMER_KEY")
-	consumerSecret := os.Getenv("WOOCOMMERCE_CONSUMER_SECRET")
-	apiUrl, err := url.Parse(baseUrl)
-	if err != nil {
-		fmt.Printf("Error parsing base URL: %v\n", err)
-		return
-	}
-	query := apiUrl.Query()
-	query.Set("consumer_key", consumerKey)
-	query.Set("consumer_secret", consumerSecret)
-	query.Set("per_page", "100")
-	apiUrl.RawQuery = query.Encode()
-
-	finalApiUrl := apiUrl.String()
-	response, err := http.Get(finalApiUrl)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products from WooCommerce API: " + err.Error()}) // Include error details
-		return
-	}
-	defer response.Body.Close()
-
-	// 2. Decode the JSON response
 	var payload types.WooCommerceProductQuery
-	if err := json.NewDecoder(response.Body).Decode(&payload); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode WooCommerce products: " + err.Error()}) // Include error details
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
 		return
 	}
 
-	// 3. Connect to Neo4j (Moved outside the loop)
+	// 1. Connect to Neo4j
 	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to Neo4j: " + err.Error()}) // Include error details
@@ -304,304 +481,60 @@ func StoreWooCommerceProducts(c *gin.Context) {
 
 	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
 	defer session.Close(ctx)
-	SecretID := payload.SecretID
-	Secret := payload.Secret
-
-	// 4. Store products in Neo4j
-	for _, product := range payload.Products {
-		// ... (Get embeddings)
-		textToEmbed := product.Description + " " + product.ShortDescription
-		// Get embeddings
-		productEmbeddings := utils.GetEmbeddings(textToEmbed)
-		// Check if embedding retrieval was successful
-		if len(productEmbeddings) == 0 {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get embeddings for product"})
-			return
-		}
-		// Construct query with individual product parameters
-		query := `
-			MATCH(s:Site {secretID: $secretID, secret: $secret})
-            CREATE(p:Product {
-                id: $id,
-                name: $name,
-                description: $description,
-                short_description: $short_description,
-                price: $price,
-                permalink: $permalink,
-                featured_image: $featured_image,
-                textEmbedding: $embeddings
-            })
-			CREATE (p)-[:BELONGS_TO]->(s)
-            RETURN p.id AS id
-        `
-		params := map[string]interface{}{
-			"secretID":          SecretID,
-			"secret":            Secret,
-			"id":                product.ID,
-			"name":              product.Name,
-			"description":       product.Description,
-			"short_description": product.ShortDescription,
-			"price":             product.Price,
-			"permalink":         product.Permalink,
-			"featured_image":    product.FeaturedImage,
-			"embeddings":        productEmbeddings,
-		}
-
-		// Execute query for each product
-		result, err := session.Run(ctx, query, params)
-		if err != nil {
-			log.Printf("Error storing product %d: %s", product.ID, err.Error())
-			continue // Skip to next product if error occurs
-		}
-
-		// Optionally: Log created product ID
-		if result.Next(ctx) {
-			createdProductID, _ := result.Record().Get("id")
-			log.Printf("Created product with ID: %v", createdProductID)
-		}
-	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Products stored successfully"})
-}
-
-func HandleAddProductWebhook(c *gin.Context) {
-	ctx := context.Background()
-
-	var payload types.WooCommerceProductQuery
-
-	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook payload"})
-		return
-	}
-
-	// Connect to Neo4j
-	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	siteID, err := utils.GetSiteIDBySecret(ctx, session, payload.SecretID, payload.Secret)
 	if err != nil {
-		log.Printf("Error connecting to Neo4j: %s", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to database"})
-		return
-	}
-	defer driver.Close(ctx)
-
-	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
-	defer session.Close(ctx)
-	SecretID := payload.SecretID
-	Secret := payload.Secret
-
-	// Construct the Cypher query
-	for _, product := range payload.Products {
-		// ... (Get embeddings)
-		textToEmbed := product.Description + " " + product.ShortDescription
-		// Get embeddings
-		productEmbeddings := utils.GetEmbeddings(textToEmbed)
-		// Check if embedding retrieval was successful
-		if len(productEmbeddings) == 0 {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get embeddings for product"})
-			return
-		}
-		// Construct query with individual product parameters
-		query := `
-			MATCH(s:Site {secretID: $secretID, secret: $secret})
-            CREATE(p:Product {
-	            id: $id,
-	            name: $name,
-	            description: $description,
-	            short_description: $short_description,
-	            price: $price,
-	            permalink: $permalink,
-	            featured_image: $featured_image,
-	            textEmbedding: $embeddings
-            })
-			CREATE (p)-[:BELONGS_TO]->(s)
-            RETURN p.id AS id
-        `
-		params := map[string]interface{}{
-			"secretID":          SecretID,
-			"secret":            Secret,
-			"id":                product.ID,
-			"name":              product.Name,
-			"description":       product.Description,
-			"short_description": product.ShortDescription,
-			"price":             product.Price,
-			"permalink":         product.Permalink,
-			"featured_image":    product.FeaturedImage,
-			"embeddings":        productEmbeddings,
-		}
-
-		// Execute query for each product
-		result, err := session.Run(ctx, query, params)
-		if err != nil {
-			log.Printf("Error storing product %d: %s", product.ID, err.Error())
-			continue // Skip to next product if error occurs
-		}
-
-		// Optionally: Log created product ID
-		if result.Next(ctx) {
-			createdProductID, _ := result.Record().Get("id")
-			log.Printf("Created product with ID: %v", createdProductID)
-		}
-	}
-
-}
-
-func HandleProductUpdateWebhook(c *gin.Context) {
-	ctx := context.Background()
-
-	var payload types.WooCommerceProductQuery
-
-	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook payload"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid site credentials"})
 		return
 	}
 
-	// Get embeddings for the product
-	textToEmbed := payload.Description + " " + payload.ShortDescription
-	productEmbeddings := utils.GetEmbeddings(textToEmbed)
-
-	// Connect to Neo4j
-	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	// 2. Queue a full sync of the site's catalog, polled through GET /api/v1/jobs/:id
+	job, _, err := utils.SubmitIngestionJob(ctx, session, siteID, utils.SyncFull)
 	if err != nil {
-		log.Printf("Error connecting to Neo4j: %s", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to database"})
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to queue product sync: " + err.Error()})
 		return
 	}
-	defer driver.Close(ctx)
 
-	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
-	defer session.Close(ctx)
-
-	SecretID := payload.SecretID
-	Secret := payload.Secret
-
-	// Construct the Cypher query
-	for _, product := range payload.Products {
-		// ... (Get embeddings)
-		textToEmbed := product.Description + " " + product.ShortDescription
-		// Get embeddings
-		productEmbeddings := utils.GetEmbeddings(textToEmbed)
-		// Check if embedding retrieval was successful
-		if len(productEmbeddings) == 0 {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get embeddings for product"})
-			return
-		}
-		// Construct query with individual product parameters
-		query := `
-			MATCH (s:Site {id: $site_id})
-			MATCH (p:Product {id: $id})-[r:BELONGS_TO]->(s)
-			SET p = {
-			   id: $id,
-			   name: $name,
-			   description: $description,
-			   short_description: $short_description,
-			   price: $price,
-			   permalink: $permalink,
-			   featured_image: $featured_image,
-			   textEmbedding: $embeddings
-			}
-			RETURN p.id AS id, s.id AS site_id
-        `
-		params := map[string]interface{}{
-			"secretID":          SecretID,
-			"secret":            Secret,
-			"id":                product.ID,
-			"name":              product.Name,
-			"description":       product.Description,
-			"short_description": product.ShortDescription,
-			"price":             product.Price,
-			"permalink":         product.Permalink,
-			"featured_image":    product.FeaturedImage,
-			"embeddings":        productEmbeddings,
-		}
-
-		// Execute query for each product
-		result, err := session.Run(ctx, query, params)
-		if err != nil {
-			log.Printf("Error updating product %d: %s", product.ID, err.Error())
-			continue // Skip to next product if error occurs
-		}
-
-		// Optionally: Log created product ID
-		if result.Next(ctx) {
-			createdProductID, _ := result.Record().Get("id")
-			log.Printf("Updated product with ID: %v", createdProductID)
-		}
-	}
+	c.JSON(http.StatusAccepted, gin.H{"job": job})
 }
 
-func HandleProductDeleteWebhook(c *gin.Context) {
-	ctx := context.Background()
-
-	var payload types.WooCommerceProductQuery
-
-	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook payload"})
-		return
-	}
-
-	// Connect to Neo4j
-	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
-	if err != nil {
-		log.Printf("Error connecting to Neo4j: %s", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to database"})
-		return
-	}
-	defer driver.Close(ctx)
-
-	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
-	defer session.Close(ctx)
-
-	for _, product := range payload.Products {
-		// Construct the Cypher query to delete the product
-		query := `
-			MATCH (p:Product {id: $id})
-			DETACH DELETE p
-		`
-
-		params := map[string]interface{}{
-			"id": product.ID,
-		}
-
-		// Execute the query
-		_, err = session.Run(ctx, query, params)
-		if err != nil {
-			log.Printf("Error deleting product in Neo4j: %s", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete product in database"})
-			return
-		}
-
-		// Return success response
-		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Product with ID %d deleted", payload.ID)})
-	}
-}
+// defaultDiagnoses is how many of the latest diagnoses v2 recommendations
+// search with when n_diagnosis is not given
+const defaultDiagnoses = 3
 
+// GetRecommendationsWooCommerce returns the site's products nearest to the
+// patient's latest diagnoses, leaving out those the patient must not get.
+// Patients missing from the graph are loaded from Postgres by their
+// IC/passport number or email
 func GetRecommendationsWooCommerce(c *gin.Context) {
 	var recquery types.WooCommerceRecommendationQuery
-	fmt.Println(c.Request.Body)
 	err := json.NewDecoder(c.Request.Body).Decode(&recquery)
-	fmt.Println(recquery)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	// isuserexist := utils.CheckIfUserExistsInNeo4J(recquery.UserId)
-	// if !isuserexist{
-	//  data := utils.GetUserDataFromPg(recquery.UserId)
-	//  result := utils.StoreUserData(data)
-	// fmt.Println(result)
-	// }
-	diagnosis, err := utils.GetUserDiagnosisFromIc(recquery.UserData.IC, recquery.NDiagnosis)
-	fmt.Println("Diagnosis", diagnosis)
+	if recquery.UserData.IC == "" && recquery.UserData.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_data.ic_passport or user_data.email is required"})
+		return
+	}
+	if recquery.NDiagnosis <= 0 {
+		recquery.NDiagnosis = defaultDiagnoses
+	}
+	var diagnosis []string
+	if recquery.UserData.IC != "" {
+		diagnosis, err = utils.GetUserDiagnosisFromIc(recquery.UserData.IC, recquery.NDiagnosis)
+	} else {
+		diagnosis, err = utils.GetUserDiagnosisFromEmail(recquery.UserData.Email, recquery.NDiagnosis)
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	combinedDiagnosis := ""
-	if len(diagnosis) > 0 {
-		combinedDiagnosis += " " + strings.Join(diagnosis, " ")
+	combinedDiagnosis := strings.TrimSpace(strings.Join(diagnosis, " "))
+	if combinedDiagnosis == "" {
+		// Searching on no text would recommend arbitrary products
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "User has no diagnoses to recommend products for"})
+		return
 	}
-	fmt.Println(combinedDiagnosis)
-	queryVector := utils.GetEmbeddings(combinedDiagnosis)
-	fmt.Println(queryVector)
 	ctx := context.Background()
 	driver, err := neo4j.NewDriverWithContext(
 		os.Getenv("NEO4J_URI"),
@@ -615,28 +548,110 @@ func GetRecommendationsWooCommerce(c *gin.Context) {
 	defer driver.Close(ctx)
 	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
 	defer session.Close(ctx)
-	query :=
+	user, err := utils.ResolveUser(ctx, session, recquery.UserData.IC, recquery.UserData.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user == nil {
+		// Without a profile the allergen and gender constraints can't apply
+		var data map[string]interface{}
+		if recquery.UserData.IC != "" {
+			data, err = utils.GetUserDataFromPgByIc(recquery.UserData.IC)
+		} else {
+			data, err = utils.GetUserDataFromPgByEmail(recquery.UserData.Email)
+		}
+		if err != nil {
+			log.Printf("Error loading user %s: %s", recquery.UserData.IC+recquery.UserData.Email, err.Error())
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		utils.StoreUserData(data)
+		if user, err = utils.ResolveUser(ctx, session, recquery.UserData.IC, recquery.UserData.Email); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+	}
+	siteID, err := utils.GetSiteIDBySecretID(ctx, session, fmt.Sprint(c.MustGet("secret_id")))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid site credentials"})
+		return
+	}
+	constraints := utils.RecommendationConstraints{User: user, SiteID: siteID, AffiliationID: recquery.AffiliationID}
+	queryVector, target, err := utils.GetQueryEmbeddings(ctx, session, combinedDiagnosis)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	query := utils.ProductVectorSearchCypher(target) +
 		`
-    CALL db.index.vector.queryNodes('product_text_embeddings', $limit, $queryVector)
-    YIELD node AS product, score
-    WHERE score > $score_threshold
-    RETURN product.id as product_id, product.name as product_name, score
+    WHERE score > $score_threshold AND coalesce(product.active, true)
+          AND (size($categories) = 0 OR EXISTS { (product)-[:IN_CATEGORY]->(c:Category) WHERE c.slug IN $categories })
+          AND (size($tags) = 0 OR EXISTS { (product)-[:TAGGED]->(t:Tag) WHERE t.slug IN $tags })
+          AND (NOT $in_stock OR product.stock_status = "instock")
+          AND (NOT $on_sale OR product.on_sale)
+          AND ($min_price IS NULL OR (product.currency = $min_currency AND product.price >= $min_price))
+          AND ($max_price IS NULL OR (product.currency = $max_currency AND product.price <= $max_price))
+    RETURN product.id as product_id, product.name as product_name,
+           product.price as price, product.regular_price as regular_price, product.sale_price as sale_price,
+           product.currency as currency,
+           product.stock_status as stock_status, product.on_sale as on_sale, product.site_id as site_id,
+           COLLECT { MATCH (product)-[:IN_CATEGORY]->(c:Category) RETURN c.slug } as categories,
+           COLLECT { MATCH (product)-[:HAS_ALLERGY]->(a:Allergens) RETURN a.type } as allergens,
+           COLLECT { MATCH (product)-[:HAS_ALLERGY]->(a:Allergens) RETURN a.key } as allergen_keys,
+           COLLECT { MATCH (product)-[:GENDER]->(g:Gender) RETURN g.type }[0] as gender,
+           COLLECT { MATCH (product)-[:IS_AFFILIATED_WITH]->(af:Affiliations) RETURN af.id } as affiliations,
+           // The cheapest in-stock variation of a variable product
+           COLLECT {
+               MATCH (product)-[:HAS_VARIATION]->(v:Variation {stock_status: "instock"})
+               WITH v ORDER BY v.price, coalesce(v.stock_quantity, 0) DESC LIMIT 1
+               RETURN v {.id, .sku, .price, .regular_price, .sale_price, .currency, .on_sale, .stock_quantity, .permalink,
+                         attributes: [(v)-[r:HAS_ATTRIBUTE]->(a:Attribute) | {name: a.name, option: r.option}]}
+           }[0] as best_variation,
+           score
+    ORDER BY score DESC
     `
 	params := map[string]interface{}{
-		"limit":           recquery.Limit,
+		"limit":           recquery.Limit * utils.RecommendationCandidates,
 		"queryVector":     queryVector,
 		"score_threshold": recquery.Score,
-	}
-	results, _ := session.ExecuteWrite(ctx,
+		"categories":      append([]string{}, recquery.Categories...),
+		"tags":            append([]string{}, recquery.Tags...),
+		"in_stock":        recquery.InStock,
+		"on_sale":         recquery.OnSale,
+		"min_price":       nil,
+		"min_currency":    nil,
+		"max_price":       nil,
+		"max_currency":    nil,
+	}
+	if recquery.MinPrice != nil {
+		params["min_price"], params["min_currency"] = recquery.MinPrice.Minor, recquery.MinPrice.Currency
+	}
+	if recquery.MaxPrice != nil {
+		params["max_price"], params["max_currency"] = recquery.MaxPrice.Minor, recquery.MaxPrice.Currency
+	}
+	results, err := session.ExecuteRead(ctx,
 		func(tx neo4j.ManagedTransaction) (any, error) {
-			result, _ := tx.Run(ctx, query, params)
-			records, _ := result.Collect(ctx)
-			return records, nil
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
 		})
-	fmt.Println(results)
-	var recommendations []map[string]any
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var rows []map[string]any
 	for _, p := range results.([]*neo4j.Record) {
-		recommendations = append(recommendations, p.AsMap())
+		recommendation := p.AsMap()
+		utils.FormatPrices(recommendation, "best_variation")
+		rows = append(rows, recommendation)
 	}
-	c.JSON(http.StatusOK, gin.H{"recommendations": recommendations})
+	recommendations, filtered := constraints.ApplyConstraints(rows, recquery.Limit)
+	c.JSON(http.StatusOK, gin.H{"recommendations": recommendations, "filtered": filtered})
 }
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// SearchProducts finds the products of the token's site matching a typed
+// query by keyword and by meaning, with each ranking's score. fusion, rrf_k
+// and vector_weight override the site's search settings
+func SearchProducts(c *gin.Context) {
+	var search struct {
+		Query        string   `json:"query"`
+		Limit        int      `json:"limit"`
+		Fusion       string   `json:"fusion"`
+		RRFK         int      `json:"rrf_k"`
+		VectorWeight *float64 `json:"vector_weight"`
+	}
+	if err := c.ShouldBindJSON(&search); err != nil || strings.TrimSpace(search.Query) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "query is required"})
+		return
+	}
+	if search.Limit == 0 {
+		search.Limit = 10
+	}
+	if search.Limit < 1 || search.Limit > 50 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 50"})
+		return
+	}
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+
+	siteID, err := utils.GetSiteIDBySecretID(ctx, session, fmt.Sprint(c.MustGet("secret_id")))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid site credentials"})
+		return
+	}
+	settings, err := utils.GetSiteSearchSettings(ctx, session, siteID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if search.Fusion != "" {
+		settings.Fusion = search.Fusion
+	}
+	if search.RRFK != 0 {
+		settings.RRFK = search.RRFK
+	}
+	if search.VectorWeight != nil {
+		settings.VectorWeight = *search.VectorWeight
+	}
+	if err := settings.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	results, err := utils.HybridSearch(ctx, session, siteID, search.Query, search.Limit, settings)
+	if err != nil {
+		log.Printf("Error searching products: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search products"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results, "settings": settings})
+}
+
+// UpdateSiteSearch sets how a site fuses keyword and vector rankings in
+// product search
+func UpdateSiteSearch(c *gin.Context) {
+	var data struct {
+		SecretID string `json:"secret_id"`
+		Secret   string `json:"secret"`
+		utils.SearchSettings
+	}
+	data.SearchSettings = utils.DefaultSearchSettings()
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+	if err := data.SearchSettings.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	siteID, err := utils.GetSiteIDBySecret(ctx, session, data.SecretID, data.Secret)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid site credentials"})
+		return
+	}
+	if err := utils.SetSiteSearchSettings(ctx, session, siteID, data.SearchSettings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": siteID, "search": data.SearchSettings})
+}
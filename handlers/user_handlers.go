@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"net/http"
 	"os"
+	"strings"
 	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 )
@@ -26,14 +28,46 @@ func UpdateUserData(c *gin.Context) {
 	defer driver.Close(ctx)
 	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
 	defer session.Close(ctx)
-	query := `MATCH(u:User {id: $id}) SET u.name = $name, u.age = $age, u.dob = date({year: $year, month: $month, day: $day}) RETURN u`
+	// Allergies, when given, replace the user's links to the shared Allergens nodes
+	query := `
+    MATCH(u:User {id: $id}) SET u.name = $name, u.age = $age, u.dob = date({year: $year, month: $month, day: $day})
+    WITH u
+    CALL {
+        WITH u
+        OPTIONAL MATCH (u)-[old:HAS_ALLERGY]->()
+        WHERE $allergies IS NOT NULL
+        DELETE old
+    }
+    CALL {
+        WITH u
+        UNWIND coalesce($allergies, []) AS allergy
+        MERGE (a:Allergens {key: allergy.key})
+        ON CREATE SET a.type = allergy.type
+        MERGE (u)-[:HAS_ALLERGY]->(a)
+    }
+    RETURN u, COLLECT { MATCH (u)-[:HAS_ALLERGY]->(a:Allergens) RETURN a.type } AS allergies`
+	var allergies any
+	if user.Allergies != nil {
+		known := []string{}
+		for _, allergy := range user.Allergies {
+			if !strings.EqualFold(strings.TrimSpace(allergy), "Not-Known") {
+				known = append(known, allergy)
+			}
+		}
+		// Allergies link to the shared Allergens node of their canonical name
+		if allergies, err = utils.ResolveAllergens(ctx, session, known); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
 	params := map[string]interface{}{
-		"id":    user.ID,
-		"name":  user.Name,
-		"age":   user.Age,
-		"year":  user.DOB.Year,
-		"month": user.DOB.Month,
-		"day":   user.DOB.Day,
+		"id":        user.ID,
+		"name":      user.Name,
+		"age":       user.Age,
+		"year":      user.DOB.Year,
+		"month":     user.DOB.Month,
+		"day":       user.DOB.Day,
+		"allergies": allergies,
 	}
 	results, _ := session.ExecuteWrite(ctx,
 		func(tx neo4j.ManagedTransaction) (any, error) {
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+func HandleAddProductWebhook(c *gin.Context) {
+	handleProductWebhook(c, "product.created")
+}
+
+func HandleProductUpdateWebhook(c *gin.Context) {
+	handleProductWebhook(c, "product.updated")
+}
+
+func HandleProductDeleteWebhook(c *gin.Context) {
+	handleProductWebhook(c, "product.deleted")
+}
+
+func HandleProductRestoreWebhook(c *gin.Context) {
+	handleProductWebhook(c, "product.restored")
+}
+
+// handleProductWebhook applies a WooCommerce product webhook to the site whose
+// secret signed it. WooCommerce sends one product per delivery, or only its id
+// once deleted, and names the event in X-WC-Webhook-Topic; topic is assumed
+// when the header is missing
+func handleProductWebhook(c *gin.Context, topic string) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook payload"})
+		return
+	}
+	// A new webhook is pinged with a form encoded, unsigned webhook_id
+	if bytes.HasPrefix(body, []byte("webhook_id=")) {
+		c.JSON(http.StatusOK, gin.H{"message": "Webhook ping received"})
+		return
+	}
+	if header := c.GetHeader("X-WC-Webhook-Topic"); header != "" {
+		topic = header
+	}
+
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		log.Printf("Error connecting to Neo4j: %s", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to database"})
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+
+	siteID, err := utils.GetSiteIDByWebhookSignature(ctx, session, body, c.GetHeader("X-WC-Webhook-Signature"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid webhook signature"})
+		return
+	}
+	var product types.WooCommerceProduct
+	if err := json.Unmarshal(body, &product); err != nil || product.ID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook payload"})
+		return
+	}
+
+	switch topic {
+	case "product.deleted":
+		removed, err := utils.RemoveWooCommerceProduct(ctx, session, siteID, product.ID)
+		if err != nil {
+			log.Printf("Error removing product %d: %s", product.ID, err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove product"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Product %d removed", product.ID), "removed": removed})
+	case "product.created", "product.updated", "product.restored":
+		// Payloads only list the ids of variations, which are fetched from the store
+		products := []types.WooCommerceProduct{product}
+		if client, err := utils.GetSiteWooCommerceClient(ctx, session, siteID); err == nil {
+			client.AttachVariations(ctx, products)
+		} else {
+			log.Printf("Error fetching variations: %s", err.Error())
+		}
+		productID, outcome, err := utils.UpsertWooCommerceProduct(ctx, session, siteID, products[0], utils.ProductSourceWebhook)
+		if err == nil && topic == "product.restored" {
+			_, err = utils.RestoreWooCommerceProduct(ctx, session, siteID, product.ID)
+		}
+		if err != nil {
+			log.Printf("Error storing product %d: %s", product.ID, err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store product"})
+			return
+		}
+		log.Printf("Product %v %s", productID, outcome)
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Product %d stored", product.ID), "product_id": productID, "outcome": outcome})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unsupported webhook topic %q", topic)})
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
 	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/handlers"
 	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/middleware"
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/migrations"
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 )
 
 func main() {
@@ -12,12 +20,40 @@ func main() {
 	if err != nil {
 		panic("Error loading .env file")
 	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "purge-embedding-cache":
+			purged, err := utils.PurgePersistedEmbeddings()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to purge embedding cache: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Purged %d cached embeddings\n", purged)
+			return
+		case "purge-products":
+			purged, err := purgeProducts()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to purge deleted products: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Purged %d deleted products\n", purged)
+			return
+		case "migrate":
+			if err := migrate(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 	r := gin.Default()
 	r.SetTrustedProxies([]string{"47.254.238.67", "127.0.0.1", "202.184.216.86"})
 	api := r.Group("/api")
 	api.POST("/authenticate", handlers.AdminAuthentication)
 	api.POST("/generate/token", handlers.CreateAPIToken)
-	api.POST("/generate/secrets", handlers.GenerateSecret)
+	api.POST("/generate/secrets", handlers.GenerateSite)
+	api.POST("/site/woocommerce", handlers.UpdateSiteWooCommerce)
+	api.POST("/site/search", handlers.UpdateSiteSearch)
 	api.GET("/secrets/get/all", handlers.GetSecrets)
 	api.GET("/check/token/expiration", handlers.CheckAPITokenExpirations)
 	api.GET("/affiliation/get/all", handlers.GetAffiliations)
@@ -25,14 +61,104 @@ func main() {
 	api.POST("/product/add/woocommerce/webhook", handlers.HandleAddProductWebhook)
 	api.POST("/product/update/woocommerce/webhook", handlers.HandleProductUpdateWebhook)
 	api.POST("/product/delete/woocommerce/webhook", handlers.HandleProductDeleteWebhook)
+	api.POST("/product/restore/woocommerce/webhook", handlers.HandleProductRestoreWebhook)
+	api.GET("/embeddings/cache/stats", handlers.GetEmbeddingCacheStats)
+	admin := api.Group("/admin")
+	admin.Use(middleware.AdminAuthenticationMiddleware())
+	admin.POST("/products", handlers.AddProduct)
+	admin.GET("/products/:id", handlers.GetProduct)
+	admin.PUT("/products/:id", handlers.EditProduct)
+	admin.DELETE("/products/:id", handlers.DeleteProduct)
+	admin.GET("/products/:id/versions", handlers.GetProductVersions)
+	admin.GET("/products/:id/versions/diff", handlers.DiffProductVersions)
+	admin.GET("/allergens", handlers.GetAllergens)
+	admin.POST("/allergens", handlers.CreateAllergen)
+	admin.PUT("/allergens/:key", handlers.UpdateAllergen)
+	admin.POST("/allergens/:key/merge", handlers.MergeAllergens)
+	admin.DELETE("/allergens/:key", handlers.DeleteAllergen)
+	admin.POST("/sites/:id/sync", handlers.SyncSite)
+	admin.GET("/sites/:id/syncs", handlers.GetSyncHistory)
+	admin.GET("/jobs/:id", handlers.GetIngestionJob)
+	admin.POST("/embeddings/cache/purge", handlers.PurgeEmbeddingCache)
+	admin.POST("/embeddings/reembed", handlers.StartReembedJob)
+	admin.GET("/embeddings/reembed/:id", handlers.GetReembedJob)
+	admin.POST("/embeddings/switch", handlers.SwitchEmbeddingTarget)
 	v1 := api.Group("/v1")
 	v1.Use(middleware.AuthenticationMiddleware())
 	v1.POST("/user/update", handlers.UpdateUserData)
 	v1.POST("/product/transactions/store", handlers.StoreProductTransactions)
 	v1.GET("/product/recommendations", handlers.GetRecommendations)
 	v1.GET("/product/get/all", handlers.GetProducts)
+	v1.GET("/products/:id", handlers.GetProductDetail)
+	v1.GET("/products/:id/similar", handlers.GetSimilarProducts)
+	v1.GET("/jobs/:id", handlers.GetSiteIngestionJob)
 	v2 := api.Group("/v2")
 	v2.Use(middleware.AuthenticationMiddleware())
 	v2.POST("/product/recommendations", handlers.GetRecommendationsWooCommerce)
+	v2.POST("/product/search", handlers.SearchProducts)
+	utils.StartIngestionWorkers(context.Background())
+	utils.ResumeReembedJobs(context.Background())
+	utils.StartSyncScheduler(context.Background())
+	utils.StartProductPurger(context.Background())
 	r.Run(":8080")
 }
+
+// purgeProducts hard deletes the products soft deleted before PRODUCT_RETENTION
+func purgeProducts() (int, error) {
+	retention := utils.ProductRetention()
+	if retention == 0 {
+		return 0, nil
+	}
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		return 0, err
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	return utils.PurgeDeletedProducts(ctx, session, retention)
+}
+
+// migrate runs `migrate [up|down|status] [-dry-run] [-steps n]`
+func migrate(args []string) error {
+	command := "up"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		command, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print the Cypher statements without running them")
+	steps := flags.Int("steps", 1, "number of migrations to roll back with down")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		return err
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+
+	switch command {
+	case "up":
+		return migrations.Up(ctx, session, os.Stdout, *dryRun)
+	case "down":
+		return migrations.Down(ctx, session, os.Stdout, *steps, *dryRun)
+	case "status":
+		statuses, err := migrations.Status(ctx, session)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt
+			}
+			fmt.Printf("%3d %-28s %s\n", status.Version, status.Name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", command)
+	}
+}
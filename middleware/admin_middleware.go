@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// AdminAuthenticationMiddleware checks the HTTP Basic credentials of an Admin
+func AdminAuthenticationMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, password, ok := c.Request.BasicAuth()
+		if !ok {
+			c.Header("WWW-Authenticate", `Basic realm="admin"`)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing admin credentials"})
+			c.Abort()
+			return
+		}
+		ctx := context.Background()
+		driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to database"})
+			c.Abort()
+			return
+		}
+		defer driver.Close(ctx)
+		session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+		defer session.Close(ctx)
+		valid, err := utils.CheckAdminCredentials(ctx, session, username, password)
+		if err != nil {
+			log.Printf("Error checking admin credentials: %s", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check admin credentials"})
+			c.Abort()
+			return
+		}
+		if !valid {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin credentials"})
+			c.Abort()
+			return
+		}
+		c.Set("admin", username)
+		c.Next()
+	}
+}
@@ -0,0 +1,72 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/utils"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+const idRewriteBatchSize = 1000
+
+// rewriteIDs replaces the counter-minted integer ids of Sites and Products
+// with UUIDv7s, keeping the old value in legacy_id, gives imported products
+// their (site_id, external_id) key and removes the Index counter nodes.
+// Relationships point at nodes rather than ids so they are left intact
+func rewriteIDs(ctx context.Context, session neo4j.SessionWithContext) error {
+	if err := assignUUIDs(ctx, session, "Site"); err != nil {
+		return err
+	}
+	// WooCommerce products used their store-local id as Product.id
+	query := `
+    MATCH (p:Product)-[:BELONGS_TO]->(s:Site)
+    WHERE p.external_id IS NULL AND toString(p.id) <> p.id
+    SET p.external_id = p.id, p.site_id = s.id
+    `
+	if err := write(ctx, session, query, nil); err != nil {
+		return err
+	}
+	if err := assignUUIDs(ctx, session, "Product"); err != nil {
+		return err
+	}
+	if err := write(ctx, session, `MATCH (i:Index) WHERE i.name IN ["product_index", "site_index"] DELETE i`, nil); err != nil {
+		return err
+	}
+	return write(ctx, session, "DROP CONSTRAINT index_name_unique IF EXISTS", nil)
+}
+
+// assignUUIDs gives every node of label whose id is not yet a string a new
+// UUIDv7, in batches
+func assignUUIDs(ctx context.Context, session neo4j.SessionWithContext, label string) error {
+	selectQuery := "MATCH (n:" + label + ") WHERE toString(n.id) <> n.id OR n.id IS NULL RETURN elementId(n) AS element_id LIMIT $limit"
+	updateQuery := `
+    UNWIND $rows AS row
+    MATCH (n) WHERE elementId(n) = row.element_id
+    SET n.legacy_id = n.id, n.id = row.id
+    `
+	for {
+		result, err := session.ExecuteRead(ctx,
+			func(tx neo4j.ManagedTransaction) (any, error) {
+				result, err := tx.Run(ctx, selectQuery, map[string]any{"limit": idRewriteBatchSize})
+				if err != nil {
+					return nil, err
+				}
+				return result.Collect(ctx)
+			})
+		if err != nil {
+			return err
+		}
+		records := result.([]*neo4j.Record)
+		if len(records) == 0 {
+			return nil
+		}
+		var rows []map[string]any
+		for _, record := range records {
+			elementID, _ := record.Get("element_id")
+			rows = append(rows, map[string]any{"element_id": elementID, "id": utils.NewID()})
+		}
+		if err := write(ctx, session, updateQuery, map[string]any{"rows": rows}); err != nil {
+			return err
+		}
+	}
+}
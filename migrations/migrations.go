@@ -0,0 +1,492 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/utils"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// Migration is a versioned schema change whose application is recorded on a
+// SchemaMigration node. Up and Down statements each run in their own
+// transaction since Neo4j does not mix schema and data changes. Data, when
+// set, runs after the Up statements for rewrites that need Go, such as
+// generating IDs
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Data    func(ctx context.Context, session neo4j.SessionWithContext) error
+	Down    []string
+}
+
+// MigrationStatus reports whether a migration has been applied
+type MigrationStatus struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	Applied   bool   `json:"applied"`
+	AppliedAt string `json:"applied_at,omitempty"`
+}
+
+// All returns every migration in version order. Vector index dimensions and
+// similarity come from EMBEDDINGS_DIMENSION and EMBEDDINGS_SIMILARITY
+func All() []Migration {
+	return []Migration{
+		{
+			Version: 1,
+			Name:    "unique ids",
+			// Product and User ids are only unique once rewritten and
+			// deduplicated, see version 17. Affiliations, which are only ever
+			// matched by id, are folded into the first of each id first
+			Up: []string{
+				"CREATE CONSTRAINT site_id_unique IF NOT EXISTS FOR (s:Site) REQUIRE s.id IS UNIQUE",
+				`MATCH (af:Affiliations) WHERE af.id IS NOT NULL
+            WITH af ORDER BY elementId(af)
+            WITH af.id AS id, collect(af) AS nodes WHERE size(nodes) > 1
+            WITH head(nodes) AS keep, tail(nodes) AS duplicates
+            UNWIND duplicates AS duplicate
+            CALL {
+                WITH keep, duplicate
+                MATCH (n)-[:IS_AFFILIATED_WITH]->(duplicate)
+                MERGE (n)-[:IS_AFFILIATED_WITH]->(keep)
+            }
+            DETACH DELETE duplicate`,
+				"CREATE CONSTRAINT affiliation_id_unique IF NOT EXISTS FOR (af:Affiliations) REQUIRE af.id IS UNIQUE",
+			},
+			Down: []string{
+				"DROP CONSTRAINT site_id_unique IF EXISTS",
+				"DROP CONSTRAINT affiliation_id_unique IF EXISTS",
+			},
+		},
+		{
+			Version: 2,
+			Name:    "id counters",
+			Up: []string{
+				"CREATE CONSTRAINT index_name_unique IF NOT EXISTS FOR (i:Index) REQUIRE i.name IS UNIQUE",
+				`MERGE (i:Index {name: "product_index"}) ON CREATE SET i.value = 0`,
+				`MERGE (i:Index {name: "site_index"}) ON CREATE SET i.value = 0`,
+			},
+			Down: []string{
+				`MATCH (i:Index) WHERE i.name IN ["product_index", "site_index"] AND i.value = 0 DELETE i`,
+				"DROP CONSTRAINT index_name_unique IF EXISTS",
+			},
+		},
+		{
+			Version: 3,
+			Name:    "vector indexes",
+			Up:      utils.VectorIndexStatements(utils.DefaultEmbeddingTarget(), utils.EmbeddingDimension()),
+			Down: []string{
+				"DROP INDEX product_text_embeddings IF EXISTS",
+				"DROP INDEX " + utils.ProductChunkIndex + " IF EXISTS",
+			},
+		},
+		{
+			Version: 4,
+			Name:    "product fulltext index",
+			Up: []string{
+				"CREATE FULLTEXT INDEX product_fulltext IF NOT EXISTS FOR (p:Product) ON EACH [p.name, p.description, p.short_description]",
+			},
+			Down: []string{
+				"DROP INDEX product_fulltext IF EXISTS",
+			},
+		},
+		{
+			Version: 5,
+			Name:    "embedding bookkeeping",
+			Up: []string{
+				"CREATE CONSTRAINT embedding_cache_key_unique IF NOT EXISTS FOR (e:EmbeddingCache) REQUIRE e.key IS UNIQUE",
+				"CREATE CONSTRAINT reembed_job_id_unique IF NOT EXISTS FOR (j:ReembedJob) REQUIRE j.id IS UNIQUE",
+			},
+			Down: []string{
+				"DROP CONSTRAINT embedding_cache_key_unique IF EXISTS",
+				"DROP CONSTRAINT reembed_job_id_unique IF EXISTS",
+			},
+		},
+		{
+			Version: 6,
+			Name:    "uuid ids",
+			Up: []string{
+				"CREATE INDEX product_site_external_id IF NOT EXISTS FOR (p:Product) ON (p.site_id, p.external_id)",
+			},
+			Data: rewriteIDs,
+			Down: []string{
+				"MATCH (s:Site) WHERE s.legacy_id IS NOT NULL SET s.id = s.legacy_id REMOVE s.legacy_id",
+				"MATCH (p:Product) WHERE p.legacy_id IS NOT NULL SET p.id = p.legacy_id REMOVE p.legacy_id, p.site_id, p.external_id",
+				"CREATE CONSTRAINT index_name_unique IF NOT EXISTS FOR (i:Index) REQUIRE i.name IS UNIQUE",
+				`MERGE (i:Index {name: "product_index"}) WITH i OPTIONAL MATCH (p:Product) WHERE toString(p.id) <> p.id WITH i, max(p.id) AS id SET i.value = coalesce(id, 0)`,
+				`MERGE (i:Index {name: "site_index"}) WITH i OPTIONAL MATCH (s:Site) WHERE toString(s.id) <> s.id WITH i, max(s.id) AS id SET i.value = coalesce(id, 0)`,
+				"DROP INDEX product_site_external_id IF EXISTS",
+			},
+		},
+		{
+			Version: 7,
+			Name:    "unique site products",
+			Up: []string{
+				// Move transactions of duplicate products onto the one kept, which
+				// both statements pick as the first by elementId
+				`MATCH (p:Product) WHERE p.external_id IS NOT NULL
+            WITH p ORDER BY elementId(p)
+            WITH p.site_id AS site_id, p.external_id AS external_id, collect(p) AS products
+            WHERE size(products) > 1
+            WITH head(products) AS keeper, tail(products) AS duplicates
+            UNWIND duplicates AS duplicate
+            MATCH (u)-[t:TRANSACTED]->(duplicate)
+            MERGE (u)-[kept:TRANSACTED]->(keeper)
+            SET kept += properties(t)
+            DELETE t`,
+				`MATCH (p:Product) WHERE p.external_id IS NOT NULL
+            WITH p ORDER BY elementId(p)
+            WITH p.site_id AS site_id, p.external_id AS external_id, collect(p) AS products
+            WHERE size(products) > 1
+            UNWIND tail(products) AS duplicate
+            OPTIONAL MATCH (duplicate)-[:HAS_CHUNK]->(c:ProductChunk)
+            DETACH DELETE duplicate, c`,
+				"DROP INDEX product_site_external_id IF EXISTS",
+				"CREATE CONSTRAINT product_site_external_id_unique IF NOT EXISTS FOR (p:Product) REQUIRE (p.site_id, p.external_id) IS UNIQUE",
+			},
+			Down: []string{
+				"DROP CONSTRAINT product_site_external_id_unique IF EXISTS",
+				"CREATE INDEX product_site_external_id IF NOT EXISTS FOR (p:Product) ON (p.site_id, p.external_id)",
+			},
+		},
+		{
+			Version: 8,
+			Name:    "sync runs",
+			Up: []string{
+				"CREATE CONSTRAINT sync_run_id_unique IF NOT EXISTS FOR (r:SyncRun) REQUIRE r.id IS UNIQUE",
+				"CREATE INDEX sync_run_site_started IF NOT EXISTS FOR (r:SyncRun) ON (r.site_id, r.started_at)",
+			},
+			Down: []string{
+				"DROP INDEX sync_run_site_started IF EXISTS",
+				"DROP CONSTRAINT sync_run_id_unique IF EXISTS",
+			},
+		},
+		{
+			Version: 9,
+			Name:    "ingestion jobs",
+			Up: []string{
+				"CREATE CONSTRAINT ingestion_job_id_unique IF NOT EXISTS FOR (j:IngestionJob) REQUIRE j.id IS UNIQUE",
+				"CREATE INDEX ingestion_job_site_status IF NOT EXISTS FOR (j:IngestionJob) ON (j.site_id, j.status)",
+			},
+			Down: []string{
+				"DROP INDEX ingestion_job_site_status IF EXISTS",
+				"DROP CONSTRAINT ingestion_job_id_unique IF EXISTS",
+			},
+		},
+		{
+			Version: 10,
+			Name:    "product taxonomy",
+			Up: []string{
+				"CREATE CONSTRAINT category_site_external_id_unique IF NOT EXISTS FOR (c:Category) REQUIRE (c.site_id, c.external_id) IS UNIQUE",
+				"CREATE CONSTRAINT tag_site_external_id_unique IF NOT EXISTS FOR (t:Tag) REQUIRE (t.site_id, t.external_id) IS UNIQUE",
+				"CREATE CONSTRAINT attribute_site_name_unique IF NOT EXISTS FOR (a:Attribute) REQUIRE (a.site_id, a.name) IS UNIQUE",
+				"CREATE INDEX category_slug IF NOT EXISTS FOR (c:Category) ON (c.slug)",
+				"CREATE INDEX product_stock_status IF NOT EXISTS FOR (p:Product) ON (p.stock_status)",
+			},
+			Down: []string{
+				"DROP INDEX product_stock_status IF EXISTS",
+				"DROP INDEX category_slug IF EXISTS",
+				"DROP CONSTRAINT attribute_site_name_unique IF EXISTS",
+				"DROP CONSTRAINT tag_site_external_id_unique IF EXISTS",
+				"DROP CONSTRAINT category_site_external_id_unique IF EXISTS",
+			},
+		},
+		{
+			Version: 11,
+			Name:    "product variations",
+			Up: []string{
+				"CREATE CONSTRAINT variation_site_external_id_unique IF NOT EXISTS FOR (v:Variation) REQUIRE (v.site_id, v.external_id) IS UNIQUE",
+				"CREATE CONSTRAINT variation_id_unique IF NOT EXISTS FOR (v:Variation) REQUIRE v.id IS UNIQUE",
+			},
+			Down: []string{
+				"DROP CONSTRAINT variation_id_unique IF EXISTS",
+				"DROP CONSTRAINT variation_site_external_id_unique IF EXISTS",
+			},
+		},
+		{
+			Version: 12,
+			Name:    "prices in minor units",
+			// WooCommerce prices were stored as decimal strings and admin
+			// prices as whole ringgit, all before sites had a currency
+			Up: []string{
+				`MATCH (p:Product) WHERE p.currency IS NULL
+            SET p.price = CASE WHEN toString(p.price) = p.price THEN toInteger(round(toFloat(p.price) * 100)) ELSE toInteger(p.price) * 100 END,
+                p.regular_price = toInteger(round(toFloat(p.regular_price) * 100)),
+                p.sale_price = toInteger(round(toFloat(p.sale_price) * 100)),
+                p.currency = "MYR"`,
+				`MATCH (v:Variation) WHERE v.currency IS NULL
+            SET v.price = toInteger(round(toFloat(v.price) * 100)),
+                v.regular_price = toInteger(round(toFloat(v.regular_price) * 100)),
+                v.sale_price = toInteger(round(toFloat(v.sale_price) * 100)),
+                v.currency = "MYR"`,
+				"CREATE INDEX product_price IF NOT EXISTS FOR (p:Product) ON (p.price)",
+			},
+			Down: []string{
+				"DROP INDEX product_price IF EXISTS",
+				`MATCH (n) WHERE (n:Product OR n:Variation) AND n.currency IS NOT NULL
+            SET n.price = toString(n.price / 100) + "." + right("0" + toString(n.price % 100), 2),
+                n.regular_price = toString(n.regular_price / 100) + "." + right("0" + toString(n.regular_price % 100), 2),
+                n.sale_price = toString(n.sale_price / 100) + "." + right("0" + toString(n.sale_price % 100), 2)
+            REMOVE n.currency`,
+			},
+		},
+		{
+			Version: 13,
+			Name:    "product soft delete",
+			Up: []string{
+				`MATCH (p:Product) WHERE p.deactivated_at IS NOT NULL
+            SET p.deleted_at = p.deactivated_at
+            REMOVE p.deactivated_at`,
+				"CREATE INDEX product_deleted_at IF NOT EXISTS FOR (p:Product) ON (p.deleted_at)",
+			},
+			Down: []string{
+				"DROP INDEX product_deleted_at IF EXISTS",
+				`MATCH (p:Product) WHERE p.deleted_at IS NOT NULL
+            SET p.deactivated_at = p.deleted_at
+            REMOVE p.deleted_at`,
+			},
+		},
+		{
+			Version: 14,
+			Name:    "product versions",
+			Up: []string{
+				"CREATE CONSTRAINT product_version_id_unique IF NOT EXISTS FOR (v:ProductVersion) REQUIRE v.id IS UNIQUE",
+				"CREATE INDEX product_version_product_id IF NOT EXISTS FOR (v:ProductVersion) ON (v.product_id, v.version)",
+			},
+			Down: []string{
+				"DROP INDEX product_version_product_id IF EXISTS",
+				"DROP CONSTRAINT product_version_id_unique IF EXISTS",
+			},
+		},
+		{
+			Version: 15,
+			Name:    "product fulltext index with sku",
+			// Version 4 created product_fulltext without sku and IF NOT EXISTS
+			// would keep that definition, so the index is rebuilt
+			Up: []string{
+				"DROP INDEX product_fulltext IF EXISTS",
+				"CREATE FULLTEXT INDEX product_fulltext IF NOT EXISTS FOR (p:Product) ON EACH [p.name, p.sku, p.short_description, p.description]",
+			},
+			Down: []string{
+				"DROP INDEX product_fulltext IF EXISTS",
+				"CREATE FULLTEXT INDEX product_fulltext IF NOT EXISTS FOR (p:Product) ON EACH [p.name, p.description, p.short_description]",
+			},
+		},
+		{
+			Version: 16,
+			Name:    "shared reference nodes",
+			// Products and users each created their own Allergens and Gender
+			// nodes. Duplicates by normalized key are folded into the first,
+			// which takes over their relationships
+			Up: []string{
+				`MATCH (a:Allergens) SET a.key = toLower(trim(a.type)), a.type = trim(a.type)`,
+				`MATCH (a:Allergens)
+            WITH a ORDER BY elementId(a)
+            WITH a.key AS key, collect(a) AS nodes WHERE size(nodes) > 1
+            WITH head(nodes) AS keep, nodes[1..] AS duplicates
+            UNWIND duplicates AS duplicate
+            CALL {
+                WITH keep, duplicate
+                MATCH (n)-[:HAS_ALLERGY]->(duplicate)
+                MERGE (n)-[:HAS_ALLERGY]->(keep)
+            }
+            DETACH DELETE duplicate`,
+				`MATCH (g:Gender)
+            WITH g, ` + utils.CanonicalGenderCypher("g.type") + ` AS type
+            SET g.type = type, g.key = toLower(type)`,
+				`MATCH (g:Gender)
+            WITH g ORDER BY elementId(g)
+            WITH g.key AS key, collect(g) AS nodes WHERE size(nodes) > 1
+            WITH head(nodes) AS keep, nodes[1..] AS duplicates
+            UNWIND duplicates AS duplicate
+            CALL {
+                WITH keep, duplicate
+                MATCH (n)-[:GENDER]->(duplicate)
+                MERGE (n)-[:GENDER]->(keep)
+            }
+            DETACH DELETE duplicate`,
+				"CREATE CONSTRAINT allergens_key_unique IF NOT EXISTS FOR (a:Allergens) REQUIRE a.key IS UNIQUE",
+				"CREATE CONSTRAINT gender_key_unique IF NOT EXISTS FOR (g:Gender) REQUIRE g.key IS UNIQUE",
+			},
+			// Folded duplicates are not recreated
+			Down: []string{
+				"DROP CONSTRAINT gender_key_unique IF EXISTS",
+				"DROP CONSTRAINT allergens_key_unique IF EXISTS",
+				"MATCH (n) WHERE n:Allergens OR n:Gender REMOVE n.key",
+				"MATCH (a:Allergens) REMOVE a.synonyms",
+			},
+		},
+		{
+			Version: 17,
+			Name:    "unique product and user ids",
+			// Users were created again each time they were stored. The first
+			// of each id takes over the transactions, allergies and gender of
+			// the others
+			Up: []string{
+				`MATCH (u:User) WHERE u.id IS NOT NULL
+            WITH u ORDER BY elementId(u)
+            WITH u.id AS id, collect(u) AS users WHERE size(users) > 1
+            WITH head(users) AS keep, tail(users) AS duplicates
+            UNWIND duplicates AS duplicate
+            CALL {
+                WITH keep, duplicate
+                MATCH (duplicate)-[t:TRANSACTED]->(p)
+                MERGE (keep)-[kept:TRANSACTED]->(p)
+                SET kept += properties(t)
+            }
+            CALL {
+                WITH keep, duplicate
+                MATCH (duplicate)-[:HAS_ALLERGY]->(a)
+                MERGE (keep)-[:HAS_ALLERGY]->(a)
+            }
+            CALL {
+                WITH keep, duplicate
+                MATCH (duplicate)-[:GENDER]->(g)
+                WHERE NOT EXISTS { (keep)-[:GENDER]->() }
+                MERGE (keep)-[:GENDER]->(g)
+            }
+            DETACH DELETE duplicate`,
+				"CREATE CONSTRAINT product_id_unique IF NOT EXISTS FOR (p:Product) REQUIRE p.id IS UNIQUE",
+				"CREATE CONSTRAINT user_id_unique IF NOT EXISTS FOR (u:User) REQUIRE u.id IS UNIQUE",
+			},
+			// Folded duplicates are not recreated
+			Down: []string{
+				"DROP CONSTRAINT user_id_unique IF EXISTS",
+				"DROP CONSTRAINT product_id_unique IF EXISTS",
+			},
+		},
+	}
+}
+
+// Status returns every migration with whether it has been applied
+func Status(ctx context.Context, session neo4j.SessionWithContext) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	for _, migration := range All() {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+// Up applies every pending migration in version order. With dryRun the
+// statements are only written to out
+func Up(ctx context.Context, session neo4j.SessionWithContext, out io.Writer, dryRun bool) error {
+	applied, err := appliedMigrations(ctx, session)
+	if err != nil {
+		return err
+	}
+	for _, migration := range All() {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		fmt.Fprintf(out, "Applying %d %s\n", migration.Version, migration.Name)
+		if err := runStatements(ctx, session, out, migration.Up, dryRun); err != nil {
+			return fmt.Errorf("migration %d failed: %v", migration.Version, err)
+		}
+		if migration.Data != nil {
+			fmt.Fprintf(out, "  (data rewrite)\n")
+			if !dryRun {
+				if err := migration.Data(ctx, session); err != nil {
+					return fmt.Errorf("migration %d failed: %v", migration.Version, err)
+				}
+			}
+		}
+		if dryRun {
+			continue
+		}
+		query := `MERGE (m:SchemaMigration {version: $version})
+            SET m.name = $name, m.applied_at = datetime()`
+		params := map[string]any{"version": migration.Version, "name": migration.Name}
+		if err := write(ctx, session, query, params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Down rolls back the last steps applied migrations, newest first. With
+// dryRun the statements are only written to out
+func Down(ctx context.Context, session neo4j.SessionWithContext, out io.Writer, steps int, dryRun bool) error {
+	applied, err := appliedMigrations(ctx, session)
+	if err != nil {
+		return err
+	}
+	migrations := All()
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		steps--
+		fmt.Fprintf(out, "Rolling back %d %s\n", migration.Version, migration.Name)
+		if err := runStatements(ctx, session, out, migration.Down, dryRun); err != nil {
+			return fmt.Errorf("rollback of migration %d failed: %v", migration.Version, err)
+		}
+		if dryRun {
+			continue
+		}
+		query := `MATCH (m:SchemaMigration {version: $version}) DELETE m`
+		if err := write(ctx, session, query, map[string]any{"version": migration.Version}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appliedMigrations(ctx context.Context, session neo4j.SessionWithContext) (map[int]string, error) {
+	query := `MATCH (m:SchemaMigration) RETURN m.version AS version, toString(m.applied_at) AS applied_at`
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, nil)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]string{}
+	for _, record := range result.([]*neo4j.Record) {
+		version, _ := record.Get("version")
+		appliedAt, _ := record.Get("applied_at")
+		applied[int(version.(int64))], _ = appliedAt.(string)
+	}
+	return applied, nil
+}
+
+func runStatements(ctx context.Context, session neo4j.SessionWithContext, out io.Writer, statements []string, dryRun bool) error {
+	for _, statement := range statements {
+		fmt.Fprintf(out, "  %s\n", statement)
+		if dryRun {
+			continue
+		}
+		if err := write(ctx, session, statement, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func write(ctx context.Context, session neo4j.SessionWithContext, query string, params map[string]any) error {
+	_, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return err
+}
@@ -0,0 +1,126 @@
+// Command benchingest measures the throughput of the ingestion pipeline on a
+// generated catalog against in-memory stand-ins for Neo4j and the embeddings
+// API, each adding a fixed latency per call:
+//
+//	go run ./test/benchingest -products 10000 -embed-latency 20ms -write-latency 15ms
+//
+// The first row, one embedding worker writing one product per transaction, is
+// how products were ingested before batching
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/utils"
+)
+
+// slowEmbedder delays the hash embedder to stand in for an embeddings API
+type slowEmbedder struct {
+	utils.HashEmbedder
+	latency time.Duration
+}
+
+func (se slowEmbedder) Embed(text string) ([]float64, error) {
+	time.Sleep(se.latency)
+	return se.HashEmbedder.Embed(text)
+}
+
+// memoryStore keeps products in memory, delaying every call to stand in for
+// a Neo4j round trip
+type memoryStore struct {
+	mu       sync.Mutex
+	latency  time.Duration
+	products map[int]map[string]any
+	writes   int
+}
+
+func (ms *memoryStore) Existing(ctx context.Context, siteID string, externalIDs []int, keys []string) (map[int]map[string]any, error) {
+	time.Sleep(ms.latency)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	existing := map[int]map[string]any{}
+	for _, id := range externalIDs {
+		if stored, ok := ms.products[id]; ok {
+			existing[id] = stored
+		}
+	}
+	return existing, nil
+}
+
+func (ms *memoryStore) Write(ctx context.Context, siteID string, upserts []*utils.ProductUpsert) error {
+	time.Sleep(ms.latency)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.writes++
+	for _, upsert := range upserts {
+		stored := map[string]any{"id": upsert.ID}
+		for key, value := range upsert.Properties {
+			stored[key] = value
+		}
+		ms.products[upsert.Product.ID] = stored
+	}
+	return nil
+}
+
+func main() {
+	count := flag.Int("products", 10000, "number of products in the catalog")
+	embedLatency := flag.Duration("embed-latency", 20*time.Millisecond, "latency of each embedding call")
+	writeLatency := flag.Duration("write-latency", 15*time.Millisecond, "latency of each database call")
+	flag.Parse()
+
+	// Keep vectors cached by one configuration from speeding up the next
+	os.Setenv("EMBEDDING_CACHE_SIZE", "1")
+
+	catalog := make([]types.WooCommerceProduct, *count)
+	for i := range catalog {
+		id := i + 1
+		catalog[i] = types.WooCommerceProduct{
+			ID:               id,
+			Name:             fmt.Sprintf("Product %d", id),
+			Price:            fmt.Sprintf("%d.90", 10+id%50),
+			Description:      fmt.Sprintf("<p>Description of product %d for <strong>daily health</strong>.</p>", id),
+			ShortDescription: fmt.Sprintf("<p>Product %d</p>", id),
+		}
+	}
+
+	configurations := []struct{ concurrency, batchSize int }{
+		{1, 1}, {1, 100}, {4, 100}, {8, 100}, {16, 250},
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(out, "concurrency\tbatch\tproducts\twrites\tseconds\tproducts/s\t")
+	for _, configuration := range configurations {
+		store := &memoryStore{latency: *writeLatency, products: map[int]map[string]any{}}
+		embedder := slowEmbedder{HashEmbedder: utils.HashEmbedder{Dimension: 384}, latency: *embedLatency}
+		target := utils.NewEmbeddingTarget(embedder.Model(), "1")
+		pipeline := &utils.IngestPipeline{
+			Store:       store,
+			Targets:     []utils.TargetEmbedder{{Target: target, Embedder: embedder}},
+			Concurrency: configuration.concurrency,
+			BatchSize:   configuration.batchSize,
+		}
+		started := time.Now()
+		counts, err := pipeline.Run(context.Background(), "bench", func(add func([]types.WooCommerceProduct) error) error {
+			for start := 0; start < len(catalog); start += 100 {
+				if err := add(catalog[start:min(start+100, len(catalog))]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Benchmark failed: %v\n", err)
+			os.Exit(1)
+		}
+		elapsed := time.Since(started).Seconds()
+		fmt.Fprintf(out, "%d\t%d\t%d\t%d\t%.1f\t%.0f\t\n", configuration.concurrency, configuration.batchSize,
+			counts.Created, store.writes, elapsed, float64(counts.Created)/elapsed)
+	}
+	out.Flush()
+}
@@ -0,0 +1,249 @@
+// Command fakewoocommerce serves a generated catalog on the WooCommerce REST
+// products endpoint so catalog sync can be exercised without a real store:
+//
+//	go run ./test/fakewoocommerce -products 250 -throttle-every 3
+//
+// It honours page, per_page, modified_after and _fields=id, and every fourth
+// product is variable with a variation per flavour. POST /remove?id=n
+// drops a product and POST /touch?id=n marks one modified now, to exercise
+// incremental syncs and removal reconciliation
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type term struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+type attribute struct {
+	ID        int      `json:"id"`
+	Name      string   `json:"name"`
+	Options   []string `json:"options"`
+	Variation bool     `json:"variation"`
+}
+
+type image struct {
+	ID  int    `json:"id"`
+	Src string `json:"src"`
+}
+
+var (
+	categories    = []term{{1, "Vitamins", "vitamins"}, {2, "Supplements", "supplements"}, {3, "Skin Care", "skin-care"}}
+	tags          = []term{{11, "Vegan", "vegan"}, {12, "Halal", "halal"}}
+	flavours      = []string{"Orange", "Mango", "Berry"}
+	stockStatuses = []string{"instock", "instock", "outofstock", "onbackorder"}
+)
+
+type variationAttribute struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Option string `json:"option"`
+}
+
+type variation struct {
+	ID            int                  `json:"id"`
+	SKU           string               `json:"sku"`
+	Price         string               `json:"price"`
+	RegularPrice  string               `json:"regular_price"`
+	StockStatus   string               `json:"stock_status"`
+	StockQuantity int                  `json:"stock_quantity"`
+	Attributes    []variationAttribute `json:"attributes"`
+}
+
+type product struct {
+	ID               int         `json:"id"`
+	Name             string      `json:"name"`
+	Slug             string      `json:"slug"`
+	Type             string      `json:"type"`
+	Price            string      `json:"price"`
+	RegularPrice     string      `json:"regular_price"`
+	SalePrice        string      `json:"sale_price"`
+	Description      string      `json:"description"`
+	ShortDescription string      `json:"short_description"`
+	Permalink        string      `json:"permalink"`
+	DateModifiedGMT  string      `json:"date_modified_gmt"`
+	Images           []image     `json:"images"`
+	StockStatus      string      `json:"stock_status"`
+	OnSale           bool        `json:"on_sale"`
+	Categories       []term      `json:"categories"`
+	Tags             []term      `json:"tags"`
+	Attributes       []attribute `json:"attributes"`
+	Variations       []int       `json:"variations"`
+}
+
+const timeLayout = "2006-01-02T15:04:05"
+
+func main() {
+	addr := flag.String("addr", ":8090", "address to listen on")
+	count := flag.Int("products", 250, "number of products in the catalog")
+	consumerKey := flag.String("consumer-key", "ck_test", "accepted consumer key")
+	consumerSecret := flag.String("consumer-secret", "cs_test", "accepted consumer secret")
+	throttleEvery := flag.Int("throttle-every", 0, "answer every nth request with 429 and Retry-After: 1")
+	flag.Parse()
+
+	started := time.Now().UTC().Format(timeLayout)
+	catalog := make([]product, *count)
+	variations := map[int][]variation{}
+	for i := range catalog {
+		id := i + 1
+		catalog[i] = product{
+			ID:               id,
+			Name:             fmt.Sprintf("Product %d", id),
+			Slug:             fmt.Sprintf("product-%d", id),
+			Price:            fmt.Sprintf("%d.90", 10+id%50),
+			RegularPrice:     fmt.Sprintf("%d.90", 10+id%50),
+			Description:      fmt.Sprintf("<p>Description of product %d for <strong>daily health</strong>.</p>", id),
+			ShortDescription: fmt.Sprintf("<p>Product %d</p>", id),
+			Permalink:        fmt.Sprintf("http://127.0.0.1%s/product/product-%d", *addr, id),
+			DateModifiedGMT:  started,
+			Images:           []image{{ID: id, Src: fmt.Sprintf("http://127.0.0.1%s/images/%d.jpg", *addr, id)}},
+			StockStatus:      stockStatuses[id%len(stockStatuses)],
+			OnSale:           id%5 == 0,
+			Categories:       []term{categories[id%len(categories)]},
+			Tags:             []term{tags[id%len(tags)]},
+			Attributes:       []attribute{{ID: 1, Name: "Flavour", Options: []string{flavours[id%len(flavours)]}}},
+			Type:             "simple",
+			Variations:       []int{},
+		}
+		if id%4 == 0 {
+			catalog[i].Type = "variable"
+			catalog[i].StockStatus = "instock"
+			catalog[i].Attributes = []attribute{{ID: 1, Name: "Flavour", Options: flavours, Variation: true}}
+			for k, flavour := range flavours {
+				variationID := 100000 + id*10 + k
+				catalog[i].Variations = append(catalog[i].Variations, variationID)
+				// The first flavour is out of stock, and the others get cheaper
+				stockStatus, stockQuantity := "instock", 10*k
+				if k == 0 {
+					stockStatus = "outofstock"
+				}
+				variations[id] = append(variations[id], variation{
+					ID:            variationID,
+					SKU:           fmt.Sprintf("P%d-%s", id, flavour),
+					Price:         fmt.Sprintf("%d.90", 10+id%50-k),
+					RegularPrice:  fmt.Sprintf("%d.90", 10+id%50-k),
+					StockStatus:   stockStatus,
+					StockQuantity: stockQuantity,
+					Attributes:    []variationAttribute{{ID: 1, Name: "Flavour", Option: flavour}},
+				})
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	requests := 0
+	http.HandleFunc("/wp-json/wc/v3/products", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		throttled := *throttleEvery > 0 && requests%*throttleEvery == 0
+		products := make([]product, 0, len(catalog))
+		modifiedAfter := r.URL.Query().Get("modified_after")
+		for _, p := range catalog {
+			// The fixed width layout compares correctly as a string
+			if modifiedAfter == "" || p.DateModifiedGMT > modifiedAfter {
+				products = append(products, p)
+			}
+		}
+		mu.Unlock()
+		if throttled {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, `{"code":"too_many_requests"}`, http.StatusTooManyRequests)
+			return
+		}
+
+		query := r.URL.Query()
+		if key, secret, _ := r.BasicAuth(); key != *consumerKey || secret != *consumerSecret {
+			http.Error(w, `{"code":"woocommerce_rest_cannot_view"}`, http.StatusUnauthorized)
+			return
+		}
+		page, err := strconv.Atoi(query.Get("page"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+		perPage, err := strconv.Atoi(query.Get("per_page"))
+		if err != nil || perPage < 1 || perPage > 100 {
+			perPage = 10
+		}
+
+		start := (page - 1) * perPage
+		if start > len(products) {
+			start = len(products)
+		}
+		end := start + perPage
+		if end > len(products) {
+			end = len(products)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-WP-Total", strconv.Itoa(len(products)))
+		w.Header().Set("X-WP-TotalPages", strconv.Itoa((len(products)+perPage-1)/perPage))
+		if query.Get("_fields") == "id" {
+			ids := make([]map[string]int, 0, end-start)
+			for _, p := range products[start:end] {
+				ids = append(ids, map[string]int{"id": p.ID})
+			}
+			json.NewEncoder(w).Encode(ids)
+			return
+		}
+		json.NewEncoder(w).Encode(products[start:end])
+	})
+
+	http.HandleFunc("/wp-json/wc/v3/products/", func(w http.ResponseWriter, r *http.Request) {
+		if key, secret, _ := r.BasicAuth(); key != *consumerKey || secret != *consumerSecret {
+			http.Error(w, `{"code":"woocommerce_rest_cannot_view"}`, http.StatusUnauthorized)
+			return
+		}
+		var id int
+		if _, err := fmt.Sscanf(r.URL.Path, "/wp-json/wc/v3/products/%d/variations", &id); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		productVariations := append([]variation{}, variations[id]...)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-WP-Total", strconv.Itoa(len(productVariations)))
+		w.Header().Set("X-WP-TotalPages", "1")
+		json.NewEncoder(w).Encode(productVariations)
+	})
+
+	http.HandleFunc("/remove", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		mu.Lock()
+		defer mu.Unlock()
+		for i, p := range catalog {
+			if p.ID == id {
+				catalog = append(catalog[:i], catalog[i+1:]...)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+
+	http.HandleFunc("/touch", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		mu.Lock()
+		defer mu.Unlock()
+		for i, p := range catalog {
+			if p.ID == id {
+				catalog[i].Name = p.Name + " (updated)"
+				catalog[i].DateModifiedGMT = time.Now().UTC().Format(timeLayout)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+
+	log.Printf("Serving %d products on %s", len(catalog), *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
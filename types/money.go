@@ -0,0 +1,156 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency of sites that have not set their own
+const DefaultCurrency = "MYR"
+
+// currencyExponents lists the currencies whose minor unit is not a hundredth
+var currencyExponents = map[string]int{
+	"JPY": 0, "KRW": 0, "VND": 0,
+	"BHD": 3, "JOD": 3, "KWD": 3, "OMR": 3, "TND": 3,
+}
+
+var currencySymbols = map[string]string{
+	"MYR": "RM", "SGD": "S$", "USD": "$", "EUR": "€", "GBP": "£", "JPY": "¥",
+}
+
+// Money is an amount in the minor units of its currency, e.g. sen for MYR, so
+// prices sort, compare and add exactly
+type Money struct {
+	Minor    int64
+	Currency string
+}
+
+// ParseCurrency returns the upper case ISO 4217 code of currency, or
+// DefaultCurrency when it is empty
+func ParseCurrency(currency string) (string, error) {
+	if currency == "" {
+		return DefaultCurrency, nil
+	}
+	code := strings.ToUpper(currency)
+	if len(code) != 3 || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return "", fmt.Errorf("invalid currency %q", currency)
+	}
+	return code, nil
+}
+
+// CurrencyExponent returns the number of decimal places of a currency
+func CurrencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[currency]; ok {
+		return exponent
+	}
+	return 2
+}
+
+// ParseMoney parses a decimal amount such as WooCommerce's "12.90", rounding
+// half away from zero to the currency's minor unit. An empty amount, which
+// WooCommerce sends for unset prices, returns nil
+func ParseMoney(amount string, currency string) (*Money, error) {
+	amount = strings.TrimSpace(amount)
+	if amount == "" {
+		return nil, nil
+	}
+	currency, err := ParseCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+	digits := strings.TrimPrefix(amount, "-")
+	negative := digits != amount
+	whole, fraction, _ := strings.Cut(digits, ".")
+	if whole == "" {
+		whole = "0"
+	}
+	if strings.Trim(whole+fraction, "0123456789") != "" {
+		return nil, fmt.Errorf("invalid amount %q", amount)
+	}
+	exponent := CurrencyExponent(currency)
+	roundUp := len(fraction) > exponent && fraction[exponent] >= '5'
+	fraction = (fraction + strings.Repeat("0", exponent))[:exponent]
+	minor, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount %q", amount)
+	}
+	if roundUp {
+		minor++
+	}
+	if negative {
+		minor = -minor
+	}
+	return &Money{Minor: minor, Currency: currency}, nil
+}
+
+// Decimal returns the amount with the currency's decimal places, e.g. "12.90"
+func (m Money) Decimal() string {
+	minor := m.Minor
+	sign := ""
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	digits := strconv.FormatInt(minor, 10)
+	exponent := CurrencyExponent(m.Currency)
+	if exponent == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+}
+
+// String formats the amount for display, e.g. "RM1,234.50"
+func (m Money) String() string {
+	decimal := strings.TrimPrefix(m.Decimal(), "-")
+	whole, fraction, hasFraction := strings.Cut(decimal, ".")
+	for i := len(whole) - 3; i > 0; i -= 3 {
+		whole = whole[:i] + "," + whole[i:]
+	}
+	if hasFraction {
+		whole += "." + fraction
+	}
+	symbol, ok := currencySymbols[m.Currency]
+	if !ok {
+		symbol = m.Currency + " "
+	}
+	if m.Minor < 0 {
+		return "-" + symbol + whole
+	}
+	return symbol + whole
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"amount":    m.Decimal(),
+		"minor":     m.Minor,
+		"currency":  m.Currency,
+		"formatted": m.String(),
+	})
+}
+
+// UnmarshalJSON accepts an amount as a number or decimal string in
+// DefaultCurrency, or an object with "amount" and "currency"
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var value struct {
+		Amount   json.Number `json:"amount"`
+		Currency string      `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &value.Amount); err != nil {
+		if err := json.Unmarshal(data, &value); err != nil {
+			return fmt.Errorf("invalid money %s", data)
+		}
+	}
+	money, err := ParseMoney(value.Amount.String(), value.Currency)
+	if err != nil {
+		return err
+	}
+	if money == nil {
+		return fmt.Errorf("missing amount")
+	}
+	*m = *money
+	return nil
+}
@@ -5,7 +5,9 @@ type User struct {
 	Name  string `json:"name"`
 	Age   int    `json:"age"`
 	Email string `json:"email"`
-	DOB   struct {
+	// Allergies replace the user's allergies when given
+	Allergies []string `json:"allergies"`
+	DOB       struct {
 		Year  int `json:"year"`
 		Month int `json:"month"`
 		Day   int `json:"day"`
@@ -24,12 +26,44 @@ type Order struct {
 }
 
 type Product struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	Price       int    `json:"price"`
-	Description string `json:"description"`
-	Allergens   string `json:"allergens"`
-	Gender      string `json:"gender"`
+	ID             string   `json:"id"`
+	Name           string   `json:"name"`
+	Price          *Money   `json:"price"`
+	Description    string   `json:"description"`
+	Allergens      []string `json:"allergens"`
+	Gender         string   `json:"gender"`
+	AffiliationIDs []int    `json:"affiliation_ids"`
+}
+
+// ProductListQuery filters and pages the product listing. Nil and empty
+// fields don't filter
+type ProductListQuery struct {
+	Limit int
+	// Sort is id, price, name or updated_at, descending when prefixed with "-"
+	Sort       string
+	Cursor     string
+	SiteID     string
+	Categories []string
+	// MinPrice and MaxPrice only match products priced in their currency
+	MinPrice     *Money
+	MaxPrice     *Money
+	AllergenFree []string
+	Gender       string
+	StockStatus  string
+	Affiliation  *int
+}
+
+// SimilarProductsQuery narrows the products similar to another. Attributes
+// are "name:option" pairs that must all match
+type SimilarProductsQuery struct {
+	Limit      int
+	Categories []string
+	Tags       []string
+	Attributes []string
+	InStock    bool
+	OnSale     bool
+	MinPrice   *Money
+	MaxPrice   *Money
 }
 
 type RecommendationQuery struct {
@@ -44,20 +78,74 @@ type EmbeddingResp struct {
 }
 
 type WooCommerceProductQuery struct {
-	SecretID string `json:"secret_id"`
-	Secret   string `json:"secret"`
-	Products []struct {
-		ID               int    `json:"id"`
-		Name             string `json:"name"`
-		Slug             string `json:"slug"`
-		Price            string `json:"price"`
-		RegularPrice     string `json:"regular_price"`
-		SalePrice        string `json:"sale_price"`
-		Description      string `json:"description"`
-		ShortDescription string `json:"short_description"`
-		Permalink        string `json:"permalink"`
-		FeaturedImage    string `json:"featured_src"`
-	} `json:"products"`
+	SecretID string               `json:"secret_id"`
+	Secret   string               `json:"secret"`
+	Products []WooCommerceProduct `json:"products"`
+}
+
+type WooCommerceProduct struct {
+	ID               int                    `json:"id"`
+	Name             string                 `json:"name"`
+	Slug             string                 `json:"slug"`
+	Type             string                 `json:"type"`
+	SKU              string                 `json:"sku"`
+	Price            string                 `json:"price"`
+	RegularPrice     string                 `json:"regular_price"`
+	SalePrice        string                 `json:"sale_price"`
+	Description      string                 `json:"description"`
+	ShortDescription string                 `json:"short_description"`
+	Permalink        string                 `json:"permalink"`
+	FeaturedImage    string                 `json:"featured_src"`
+	Images           []WooCommerceImage     `json:"images"`
+	StockStatus      string                 `json:"stock_status"`
+	OnSale           bool                   `json:"on_sale"`
+	Categories       []WooCommerceTerm      `json:"categories"`
+	Tags             []WooCommerceTerm      `json:"tags"`
+	Attributes       []WooCommerceAttribute `json:"attributes"`
+	// VariationIDs lists the variations of a variable product, which are
+	// fetched separately into Variations
+	VariationIDs []int                  `json:"variations"`
+	Variations   []WooCommerceVariation `json:"-"`
+}
+
+type WooCommerceVariation struct {
+	ID            int                             `json:"id"`
+	SKU           string                          `json:"sku"`
+	Price         string                          `json:"price"`
+	RegularPrice  string                          `json:"regular_price"`
+	SalePrice     string                          `json:"sale_price"`
+	OnSale        bool                            `json:"on_sale"`
+	StockStatus   string                          `json:"stock_status"`
+	StockQuantity *int                            `json:"stock_quantity"`
+	Permalink     string                          `json:"permalink"`
+	Image         *WooCommerceImage               `json:"image"`
+	Attributes    []WooCommerceVariationAttribute `json:"attributes"`
+}
+
+type WooCommerceVariationAttribute struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Option string `json:"option"`
+}
+
+type WooCommerceTerm struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+type WooCommerceAttribute struct {
+	ID        int      `json:"id"`
+	Name      string   `json:"name"`
+	Options   []string `json:"options"`
+	Variation bool     `json:"variation"`
+}
+
+type WooCommerceImage struct {
+	ID   int    `json:"id"`
+	Src  string `json:"src"`
+	Name string `json:"name"`
+	Alt  string `json:"alt"`
 }
 
 type WooCommerceRecommendationQuery struct {
@@ -65,7 +153,17 @@ type WooCommerceRecommendationQuery struct {
 	Query      string  `json:"query"`
 	Score      float64 `json:"score"`
 	NDiagnosis int     `json:"n_diagnosis"`
-	UserData   struct {
+	// Categories and Tags are slugs, matching products in any of them
+	Categories []string `json:"categories"`
+	Tags       []string `json:"tags"`
+	InStock    bool     `json:"in_stock"`
+	OnSale     bool     `json:"on_sale"`
+	// MinPrice and MaxPrice only match products priced in their currency
+	MinPrice *Money `json:"min_price"`
+	MaxPrice *Money `json:"max_price"`
+	// AffiliationID excludes products affiliated only with other affiliations
+	AffiliationID *int `json:"affiliation_id"`
+	UserData      struct {
 		ID    int    `json:"id"`
 		IC    string `json:"ic_passport"`
 		Email string `json:"email"`
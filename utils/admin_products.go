@@ -0,0 +1,355 @@
+package utils
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// Genders a product can be recommended to
+var productGenders = []string{"Male", "Female", "Unisex"}
+
+// noKnownAllergen is the Allergens type of products without allergens
+const noKnownAllergen = "Not-Known"
+
+// CheckAdminCredentials reports whether username and password match an Admin
+func CheckAdminCredentials(ctx context.Context, session neo4j.SessionWithContext, username string, password string) (bool, error) {
+	query := `MATCH (a:Admin {username: $username}) RETURN a.password AS password`
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"username": username})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return false, err
+	}
+	for _, record := range result.([]*neo4j.Record) {
+		stored, _ := record.Get("password")
+		if subtle.ConstantTimeCompare([]byte(fmt.Sprint(stored)), []byte(password)) == 1 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ValidateProduct checks a product curated by an admin, defaulting its gender
+// to Unisex and its allergens to Not-Known
+func ValidateProduct(product *types.Product) error {
+	product.Name = strings.TrimSpace(product.Name)
+	if product.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if product.Price != nil && product.Price.Minor < 0 {
+		return fmt.Errorf("price must not be negative")
+	}
+	if product.Gender == "" {
+		product.Gender = "Unisex"
+	}
+	gender, err := ParseGender(product.Gender)
+	if err != nil {
+		return err
+	}
+	product.Gender = gender
+	allergens := []string{}
+	for _, allergen := range product.Allergens {
+		if allergen = strings.TrimSpace(allergen); allergen != "" {
+			allergens = append(allergens, allergen)
+		}
+	}
+	if len(allergens) == 0 {
+		allergens = []string{noKnownAllergen}
+	}
+	product.Allergens = allergens
+	if product.AffiliationIDs == nil {
+		product.AffiliationIDs = []int{}
+	}
+	return nil
+}
+
+// ParseGender returns the product Gender type of gender, written any way
+// CanonicalGender knows
+func ParseGender(gender string) (string, error) {
+	canonical := CanonicalGender(gender)
+	for _, known := range productGenders {
+		if canonical == known {
+			return known, nil
+		}
+	}
+	return "", fmt.Errorf("gender must be one of %s", strings.Join(productGenders, ", "))
+}
+
+// MissingAffiliations returns the ids among ids without an Affiliations node
+func MissingAffiliations(ctx context.Context, session neo4j.SessionWithContext, ids []int) ([]int, error) {
+	query := `
+    UNWIND $ids AS id
+    OPTIONAL MATCH (af:Affiliations {id: id})
+    WITH id, af WHERE af IS NULL
+    RETURN collect(id) AS missing
+    `
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"ids": ids})
+			if err != nil {
+				return nil, err
+			}
+			return result.Single(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	values, _ := result.(*neo4j.Record).Get("missing")
+	missing := []int{}
+	for _, value := range values.([]any) {
+		missing = append(missing, int(value.(int64)))
+	}
+	return missing, nil
+}
+
+// adminEmbedTextFields returns EmbedTextFields with the name first when it is
+// left out, as it is by default. Curated products have no short description,
+// so their name is often most of what there is to embed
+func adminEmbedTextFields() []string {
+	fields := EmbedTextFields()
+	for _, field := range fields {
+		if field == "name" {
+			return fields
+		}
+	}
+	return append([]string{"name"}, fields...)
+}
+
+// SaveAdminProduct creates the validated product, or replaces the product
+// with id, embedding its name and description when they changed and linking
+// it to its Allergens, Gender and Affiliations. The change, references
+// included, is recorded as a ProductVersion from ProductSourceAdmin. found is
+// false when id is not a product
+func SaveAdminProduct(ctx context.Context, session neo4j.SessionWithContext, id string, product types.Product) (string, bool, error) {
+	text := PrepareProductTextFields(types.WooCommerceProduct{Name: product.Name, Description: product.Description}, adminEmbedTextFields())
+	properties := map[string]any{
+		"name":         product.Name,
+		"description":  product.Description,
+		"price":        nil,
+		"currency":     nil,
+		"content_hash": ContentHash(text),
+	}
+	if product.Price != nil {
+		properties["price"], properties["currency"] = product.Price.Minor, product.Price.Currency
+	}
+	allergens, err := ResolveAllergens(ctx, session, product.Allergens)
+	if err != nil {
+		return "", false, err
+	}
+	affiliationIDs := append([]int{}, product.AffiliationIDs...)
+	sort.Ints(affiliationIDs)
+	versioned := map[string]any{"allergens": allergenTypes(allergens), "gender": product.Gender, "affiliation_ids": affiliationIDs}
+	for key, value := range properties {
+		versioned[key] = value
+	}
+
+	var stored map[string]any
+	if id == "" {
+		id = NewID()
+	} else {
+		var found bool
+		if stored, found, err = storedAdminProduct(ctx, session, id, properties); err != nil || !found {
+			return "", found, err
+		}
+	}
+	version := productVersion(ProductSourceAdmin, stored, versioned)
+
+	var chunks []map[string]any
+	if stored == nil || stored["content_hash"] != properties["content_hash"] {
+		targets, err := embeddingWriteTargets(ctx, session)
+		if err != nil {
+			return "", true, err
+		}
+		embeddings, err := productEmbeddings(targets, text)
+		if err != nil {
+			return "", true, err
+		}
+		if chunks, err = embedChunks(targets, text); err != nil {
+			return "", true, err
+		}
+		for key, value := range embeddings {
+			properties[key] = value
+		}
+	}
+	return id, true, writeAdminProduct(ctx, session, id, product, allergens, properties, chunks, version)
+}
+
+// storedAdminProduct reads the properties of a product compared by
+// SaveAdminProduct, with its sorted allergens, gender and affiliation ids
+func storedAdminProduct(ctx context.Context, session neo4j.SessionWithContext, id string, properties map[string]any) (map[string]any, bool, error) {
+	var keys []string
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	query := `
+    MATCH (p:Product {id: $id})
+    RETURN [key IN $keys | p[key]] AS values,
+           COLLECT { MATCH (p)-[:HAS_ALLERGY]->(a:Allergens) RETURN a.type ORDER BY a.type } AS allergens,
+           head(COLLECT { MATCH (p)-[:GENDER]->(g:Gender) RETURN g.type }) AS gender,
+           COLLECT { MATCH (p)-[:IS_AFFILIATED_WITH]->(af:Affiliations) RETURN af.id ORDER BY af.id } AS affiliation_ids
+    `
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"id": id, "keys": keys})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, false, err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return nil, false, nil
+	}
+	values, _ := records[0].Get("values")
+	stored := map[string]any{}
+	for i, value := range values.([]any) {
+		stored[keys[i]] = value
+	}
+	for _, key := range []string{"allergens", "gender", "affiliation_ids"} {
+		stored[key], _ = records[0].Get(key)
+	}
+	return stored, true, nil
+}
+
+func writeAdminProduct(ctx context.Context, session neo4j.SessionWithContext, id string, product types.Product, allergens []map[string]any, properties map[string]any, chunks []map[string]any, version map[string]any) error {
+	query := `
+    MERGE (p:Product {id: $id})
+    ON CREATE SET p.created_at = datetime()
+    SET p += $properties, p.updated_at = datetime()
+    WITH p
+    CALL {
+        WITH p
+        OPTIONAL MATCH (p)-[old:HAS_ALLERGY|GENDER|IS_AFFILIATED_WITH]->()
+        DELETE old
+    }
+    CALL {
+        WITH p
+        UNWIND $allergens AS allergen
+        MERGE (a:Allergens {key: allergen.key})
+        ON CREATE SET a.type = allergen.type
+        MERGE (p)-[:HAS_ALLERGY]->(a)
+    }
+    CALL {
+        WITH p
+        MERGE (g:Gender {key: toLower($gender)})
+        ON CREATE SET g.type = $gender
+        MERGE (p)-[:GENDER]->(g)
+    }
+    CALL {
+        WITH p
+        UNWIND $affiliation_ids AS affiliation_id
+        MATCH (af:Affiliations {id: affiliation_id})
+        MERGE (p)-[:IS_AFFILIATED_WITH]->(af)
+    }
+    CALL {
+        WITH p
+        UNWIND CASE WHEN $version IS NULL THEN [] ELSE [$version] END AS version` + productVersionCypher + `
+    }
+    CALL {
+        WITH p
+        OPTIONAL MATCH (p)-[:HAS_CHUNK]->(old:ProductChunk)
+        WHERE $chunks IS NOT NULL
+        DETACH DELETE old
+    }
+    CALL {
+        WITH p
+        UNWIND coalesce($chunks, []) AS chunk
+        CREATE (p)-[:HAS_CHUNK]->(c:ProductChunk {index: chunk.index, text: chunk.text})
+        SET c += chunk.embeddings
+    }
+    `
+	params := map[string]any{
+		"id":              id,
+		"properties":      properties,
+		"allergens":       allergens,
+		"gender":          product.Gender,
+		"affiliation_ids": product.AffiliationIDs,
+		"version":         version,
+		"chunks":          nil,
+	}
+	if chunks != nil {
+		params["chunks"] = chunks
+	}
+	_, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return err
+}
+
+// GetProduct returns a product, deleted or not, with its allergens, gender
+// and affiliations and its prices formatted
+func GetProduct(ctx context.Context, session neo4j.SessionWithContext, id string) (map[string]any, bool, error) {
+	query := `
+    MATCH (p:Product {id: $id})
+    RETURN p {.id, .name, .description, .price, .currency, .site_id, .external_id, .version,
+              active: coalesce(p.active, true), deleted_at: toString(p.deleted_at), deleted_by: p.deleted_by,
+              created_at: toString(p.created_at), updated_at: toString(p.updated_at),
+              allergens: [(p)-[:HAS_ALLERGY]->(a:Allergens) | a.type],
+              gender: head([(p)-[:GENDER]->(g:Gender) | g.type]),
+              affiliations: [(p)-[:IS_AFFILIATED_WITH]->(af:Affiliations) | af {.id, .name}]} AS product
+    `
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"id": id})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, false, err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return nil, false, nil
+	}
+	value, _ := records[0].Get("product")
+	product := value.(map[string]any)
+	FormatPrices(product)
+	return product, true, nil
+}
+
+// DeleteProduct soft deletes a product, returning whether it was found
+func DeleteProduct(ctx context.Context, session neo4j.SessionWithContext, id string) (bool, error) {
+	query := `
+    MATCH (p:Product {id: $id})
+    // An admin's delete is not undone by a sync listing the product again
+    SET p.active = false, p.deleted_at = coalesce(p.deleted_at, datetime()), p.deleted_by = "` + ProductSourceAdmin + `"
+    RETURN count(p) AS deleted
+    `
+	result, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"id": id})
+			if err != nil {
+				return nil, err
+			}
+			record, err := result.Single(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return record.Values[0], nil
+		})
+	if err != nil {
+		return false, err
+	}
+	return result.(int64) > 0, nil
+}
@@ -0,0 +1,362 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// Allergen is a canonical Allergens node of the allergen vocabulary. Products
+// and users link to it whichever of its synonyms they were given
+type Allergen struct {
+	Key      string   `json:"key"`
+	Type     string   `json:"type"`
+	Synonyms []string `json:"synonyms"`
+	Products int64    `json:"products"`
+	Users    int64    `json:"users"`
+}
+
+// ReferenceKey normalizes an allergen or gender to the key its shared node is
+// merged by, the same way the shared reference nodes migration does
+func ReferenceKey(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// genderAliases maps the reference keys of the ways patients' and products'
+// genders are written to their Gender type
+var genderAliases = map[string]string{
+	"":        "Unknown",
+	"unknown": "Unknown",
+	"m":       "Male",
+	"male":    "Male",
+	"man":     "Male",
+	"men":     "Male",
+	"f":       "Female",
+	"female":  "Female",
+	"woman":   "Female",
+	"women":   "Female",
+	"unisex":  "Unisex",
+}
+
+// CanonicalGender returns the Gender type of a gender from any source, or its
+// trimmed value when it is no known gender
+func CanonicalGender(gender string) string {
+	if canonical, ok := genderAliases[ReferenceKey(gender)]; ok {
+		return canonical
+	}
+	return strings.TrimSpace(gender)
+}
+
+// CanonicalGenderCypher is CanonicalGender as a Cypher expression of the
+// gender expression, for migrations rewriting stored genders
+func CanonicalGenderCypher(gender string) string {
+	keys := make([]string, 0, len(genderAliases))
+	for key := range genderAliases {
+		// Map keys can't be empty, blank genders are handled on their own
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	aliases := make([]string, 0, len(keys))
+	for _, key := range keys {
+		aliases = append(aliases, fmt.Sprintf("`%s`: %q", key, genderAliases[key]))
+	}
+	key := fmt.Sprintf("toLower(trim(coalesce(%s, \"\")))", gender)
+	return fmt.Sprintf("CASE %s WHEN \"\" THEN %q ELSE coalesce({%s}[%s], trim(%s)) END",
+		key, genderAliases[""], strings.Join(aliases, ", "), key, gender)
+}
+
+// ResolveAllergens maps allergen names to the {key, type} of their canonical
+// Allergens node, through its synonyms, dropping blanks and duplicates. Names
+// outside the vocabulary become their own allergen
+func ResolveAllergens(ctx context.Context, session neo4j.SessionWithContext, names []string) ([]map[string]any, error) {
+	keys := []string{}
+	types := map[string]string{}
+	for _, name := range names {
+		key := ReferenceKey(name)
+		if _, seen := types[key]; key == "" || seen {
+			continue
+		}
+		keys = append(keys, key)
+		types[key] = strings.TrimSpace(name)
+	}
+	query := `
+    UNWIND $keys AS key
+    MATCH (a:Allergens)
+    WHERE a.key = key OR key IN coalesce(a.synonyms, [])
+    RETURN key, a.key AS canonical_key, a.type AS type
+    `
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"keys": keys})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	canonical := map[string][2]string{}
+	for _, record := range result.([]*neo4j.Record) {
+		key, _ := record.Get("key")
+		canonicalKey, _ := record.Get("canonical_key")
+		canonicalType, _ := record.Get("type")
+		canonical[key.(string)] = [2]string{fmt.Sprint(canonicalKey), fmt.Sprint(canonicalType)}
+	}
+	allergens := []map[string]any{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		allergen := [2]string{key, types[key]}
+		if found, ok := canonical[key]; ok {
+			allergen = found
+		}
+		if seen[allergen[0]] {
+			continue
+		}
+		seen[allergen[0]] = true
+		allergens = append(allergens, map[string]any{"key": allergen[0], "type": allergen[1]})
+	}
+	return allergens, nil
+}
+
+// allergenTypes returns the sorted types of resolved allergens
+func allergenTypes(allergens []map[string]any) []string {
+	names := []string{}
+	for _, allergen := range allergens {
+		names = append(names, allergen["type"].(string))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ListAllergens returns the allergen vocabulary with how many products and
+// users link to each allergen
+func ListAllergens(ctx context.Context, session neo4j.SessionWithContext) ([]Allergen, error) {
+	query := `
+    MATCH (a:Allergens)
+    RETURN a.key AS key, a.type AS type, coalesce(a.synonyms, []) AS synonyms,
+           COUNT { (:Product)-[:HAS_ALLERGY]->(a) } AS products,
+           COUNT { (:User)-[:HAS_ALLERGY]->(a) } AS users
+    ORDER BY a.key
+    `
+	return readAllergens(ctx, session, query, nil)
+}
+
+func getAllergen(ctx context.Context, tx neo4j.ManagedTransaction, key string) (*Allergen, error) {
+	result, err := tx.Run(ctx, `
+    MATCH (a:Allergens {key: $key})
+    RETURN a.key AS key, a.type AS type, coalesce(a.synonyms, []) AS synonyms,
+           COUNT { (:Product)-[:HAS_ALLERGY]->(a) } AS products,
+           COUNT { (:User)-[:HAS_ALLERGY]->(a) } AS users
+    `, map[string]any{"key": key})
+	if err != nil {
+		return nil, err
+	}
+	records, err := result.Collect(ctx)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	allergen := toAllergen(records[0])
+	return &allergen, nil
+}
+
+func readAllergens(ctx context.Context, session neo4j.SessionWithContext, query string, params map[string]any) ([]Allergen, error) {
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	allergens := []Allergen{}
+	for _, record := range result.([]*neo4j.Record) {
+		allergens = append(allergens, toAllergen(record))
+	}
+	return allergens, nil
+}
+
+func toAllergen(record *neo4j.Record) Allergen {
+	allergen := Allergen{Synonyms: []string{}}
+	key, _ := record.Get("key")
+	name, _ := record.Get("type")
+	synonyms, _ := record.Get("synonyms")
+	allergen.Key, allergen.Type = fmt.Sprint(key), fmt.Sprint(name)
+	for _, synonym := range synonyms.([]any) {
+		allergen.Synonyms = append(allergen.Synonyms, fmt.Sprint(synonym))
+	}
+	products, _ := record.Get("products")
+	users, _ := record.Get("users")
+	allergen.Products, allergen.Users = products.(int64), users.(int64)
+	return allergen
+}
+
+// allergenConflict returns the key of another allergen already named by any
+// of keys, as its own key or a synonym
+func allergenConflict(ctx context.Context, tx neo4j.ManagedTransaction, key string, keys []string) (string, error) {
+	result, err := tx.Run(ctx, `
+    MATCH (a:Allergens)
+    WHERE a.key <> $key AND any(k IN $keys WHERE k = a.key OR k IN coalesce(a.synonyms, []))
+    RETURN a.key AS key LIMIT 1
+    `, map[string]any{"key": key, "keys": keys})
+	if err != nil {
+		return "", err
+	}
+	records, err := result.Collect(ctx)
+	if err != nil || len(records) == 0 {
+		return "", err
+	}
+	conflict, _ := records[0].Get("key")
+	return fmt.Sprint(conflict), nil
+}
+
+func synonymKeys(key string, synonyms []string) []string {
+	keys := []string{}
+	seen := map[string]bool{key: true}
+	for _, synonym := range synonyms {
+		if synonym = ReferenceKey(synonym); synonym != "" && !seen[synonym] {
+			seen[synonym] = true
+			keys = append(keys, synonym)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CreateAllergen adds an allergen named name to the vocabulary. conflict is
+// the key of an allergen already known by name or one of the synonyms, in
+// which case nothing is created
+func CreateAllergen(ctx context.Context, session neo4j.SessionWithContext, name string, synonyms []string) (allergen *Allergen, conflict string, err error) {
+	name = strings.TrimSpace(name)
+	key := ReferenceKey(name)
+	keys := synonymKeys(key, synonyms)
+	_, err = session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			if conflict, err = allergenConflict(ctx, tx, "", append([]string{key}, keys...)); err != nil || conflict != "" {
+				return nil, err
+			}
+			result, err := tx.Run(ctx, `CREATE (:Allergens {key: $key, type: $type, synonyms: $synonyms})`,
+				map[string]any{"key": key, "type": name, "synonyms": keys})
+			if err != nil {
+				return nil, err
+			}
+			if _, err := result.Consume(ctx); err != nil {
+				return nil, err
+			}
+			allergen, err = getAllergen(ctx, tx, key)
+			return nil, err
+		})
+	return allergen, conflict, err
+}
+
+// UpdateAllergen renames the allergen key, when name is not empty, and
+// replaces its synonyms. A name with another key re-keys the allergen and
+// keeps the old key as a synonym. conflict is the key of another allergen
+// already known by the name or one of the synonyms, in which case nothing is
+// saved; found is false when key is not an allergen
+func UpdateAllergen(ctx context.Context, session neo4j.SessionWithContext, key string, name string, synonyms []string) (allergen *Allergen, found bool, conflict string, err error) {
+	name = strings.TrimSpace(name)
+	newKey := key
+	if name != "" {
+		newKey = ReferenceKey(name)
+		if newKey != key {
+			synonyms = append(synonyms, key)
+		}
+	}
+	keys := synonymKeys(newKey, synonyms)
+	_, err = session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			if allergen, err = getAllergen(ctx, tx, key); err != nil || allergen == nil {
+				return nil, err
+			}
+			if conflict, err = allergenConflict(ctx, tx, key, append([]string{newKey}, keys...)); err != nil || conflict != "" {
+				allergen = nil
+				return nil, err
+			}
+			if name == "" {
+				name = allergen.Type
+			}
+			result, err := tx.Run(ctx, `
+            MATCH (a:Allergens {key: $key})
+            SET a.key = $new_key, a.type = $type, a.synonyms = $synonyms
+            `, map[string]any{"key": key, "new_key": newKey, "type": name, "synonyms": keys})
+			if err != nil {
+				return nil, err
+			}
+			if _, err := result.Consume(ctx); err != nil {
+				return nil, err
+			}
+			allergen, err = getAllergen(ctx, tx, newKey)
+			return nil, err
+		})
+	return allergen, allergen != nil || conflict != "", conflict, err
+}
+
+// MergeAllergens folds the allergens keyed from into the allergen key: their
+// products and users link to it instead and their keys and synonyms become
+// its synonyms. found is false when key is not an allergen
+func MergeAllergens(ctx context.Context, session neo4j.SessionWithContext, key string, from []string) (*Allergen, bool, error) {
+	query := `
+    MATCH (keep:Allergens {key: $key})
+    UNWIND [k IN $from WHERE k <> $key] AS fromKey
+    MATCH (duplicate:Allergens {key: fromKey})
+    CALL {
+        WITH keep, duplicate
+        MATCH (n)-[:HAS_ALLERGY]->(duplicate)
+        MERGE (n)-[:HAS_ALLERGY]->(keep)
+    }
+    WITH keep, duplicate, [duplicate.key] + coalesce(duplicate.synonyms, []) AS names
+    DETACH DELETE duplicate
+    WITH keep, collect(names) AS merged
+    SET keep.synonyms = reduce(synonyms = coalesce(keep.synonyms, []), names IN merged |
+                               synonyms + [name IN names WHERE NOT name IN synonyms])
+    `
+	fromKeys := []string{}
+	for _, name := range from {
+		fromKeys = append(fromKeys, ReferenceKey(name))
+	}
+	var allergen *Allergen
+	_, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"key": key, "from": fromKeys})
+			if err != nil {
+				return nil, err
+			}
+			if _, err := result.Consume(ctx); err != nil {
+				return nil, err
+			}
+			allergen, err = getAllergen(ctx, tx, key)
+			return nil, err
+		})
+	return allergen, allergen != nil, err
+}
+
+// DeleteAllergen deletes an allergen no product or user links to. inUse is
+// true when one does, in which case it is kept
+func DeleteAllergen(ctx context.Context, session neo4j.SessionWithContext, key string) (found bool, inUse bool, err error) {
+	_, err = session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			allergen, err := getAllergen(ctx, tx, key)
+			if err != nil || allergen == nil {
+				return nil, err
+			}
+			found = true
+			if inUse = allergen.Products > 0 || allergen.Users > 0; inUse {
+				return nil, nil
+			}
+			result, err := tx.Run(ctx, `MATCH (a:Allergens {key: $key}) DETACH DELETE a`, map[string]any{"key": key})
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return found, inUse, err
+}
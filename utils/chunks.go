@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+const (
+	// ProductChunkIndex is the default vector index over ProductChunk.textEmbedding
+	ProductChunkIndex = "product_chunk_embeddings"
+
+	defaultChunkSize    = 200
+	defaultChunkOverlap = 40
+	// chunkCandidates is how many chunks are fetched per requested product, so
+	// products matching on several passages are still aggregated
+	chunkCandidates = 4
+)
+
+// ChunkSettings returns the chunk size and overlap in words from
+// EMBED_CHUNK_SIZE and EMBED_CHUNK_OVERLAP
+func ChunkSettings() (int, int) {
+	size, overlap := defaultChunkSize, defaultChunkOverlap
+	if value, err := strconv.Atoi(os.Getenv("EMBED_CHUNK_SIZE")); err == nil && value > 0 {
+		size = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("EMBED_CHUNK_OVERLAP")); err == nil && value >= 0 {
+		overlap = value
+	}
+	if overlap >= size {
+		overlap = size / 2
+	}
+	return size, overlap
+}
+
+// ChunkText splits text into chunks of size words where consecutive chunks
+// share overlap words
+func ChunkText(text string, size int, overlap int) []string {
+	words := strings.Fields(text)
+	if len(words) == 0 || size <= 0 {
+		return nil
+	}
+	if overlap < 0 || overlap >= size {
+		overlap = 0
+	}
+	var chunks []string
+	for start := 0; ; start += size - overlap {
+		end := start + size
+		if end > len(words) {
+			end = len(words)
+		}
+		chunks = append(chunks, strings.Join(words[start:end], " "))
+		if end == len(words) {
+			return chunks
+		}
+	}
+}
+
+// StoreProductChunks replaces the ProductChunk nodes of a product with freshly
+// embedded chunks of text
+func StoreProductChunks(ctx context.Context, session neo4j.SessionWithContext, productID any, text string) error {
+	targets, err := embeddingWriteTargets(ctx, session)
+	if err != nil {
+		return err
+	}
+	chunks, err := embedChunks(targets, text)
+	if err != nil {
+		return fmt.Errorf("product %v: %v", productID, err)
+	}
+	query := `
+    MATCH (p:Product {id: $id})
+    OPTIONAL MATCH (p)-[:HAS_CHUNK]->(old:ProductChunk)
+    DETACH DELETE old
+    WITH DISTINCT p
+    UNWIND $chunks AS chunk
+    CREATE (p)-[:HAS_CHUNK]->(c:ProductChunk {index: chunk.index, text: chunk.text})
+    SET c += chunk.embeddings
+    `
+	params := map[string]any{
+		"id":     productID,
+		"chunks": chunks,
+	}
+	_, err = session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return err
+}
+
+// embedChunks splits text into chunks with their vectors for targets, as the
+// $chunks parameter of the queries creating ProductChunk nodes
+func embedChunks(targets []TargetEmbedder, text string) ([]map[string]any, error) {
+	size, overlap := ChunkSettings()
+	chunks := []map[string]any{}
+	for i, chunk := range ChunkText(text, size, overlap) {
+		embeddings, err := embedForTargets(targets, chunk)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %v", i, err)
+		}
+		chunks = append(chunks, map[string]any{
+			"index":      i,
+			"text":       chunk,
+			"embeddings": embeddings,
+		})
+	}
+	return chunks, nil
+}
+
+// ChunkAggregation returns how chunk scores are combined into a product score,
+// "max" (default), "mean", or "none" to search whole-product embeddings only,
+// from RECOMMENDATION_CHUNK_AGGREGATION. "mean" averages the chunks of a
+// product that are among the nearest $limit * chunkCandidates, not all of them
+func ChunkAggregation() string {
+	switch aggregation := os.Getenv("RECOMMENDATION_CHUNK_AGGREGATION"); aggregation {
+	case "mean", "none":
+		return aggregation
+	default:
+		return "max"
+	}
+}
+
+// ProductVectorSearchCypher returns the Cypher that yields up to $limit
+// `product` rows with their `score` for $queryVector against the indexes of
+// target. Products without chunks are scored by their whole-product
+// embedding. Callers may follow it directly with a WHERE clause
+func ProductVectorSearchCypher(target EmbeddingTarget) string {
+	aggregation := ChunkAggregation()
+	if aggregation == "none" {
+		return fmt.Sprintf(`
+    CALL db.index.vector.queryNodes('%s', $limit, $queryVector)
+    YIELD node AS product, score
+    `, target.Index)
+	}
+	function := "max"
+	if aggregation == "mean" {
+		function = "avg"
+	}
+	return fmt.Sprintf(`
+    CALL {
+        CALL db.index.vector.queryNodes('%s', $limit * %d, $queryVector)
+        YIELD node AS chunk, score AS chunkScore
+        MATCH (product:Product)-[:HAS_CHUNK]->(chunk)
+        // Drop deleted products before they take a place in the limit
+        WHERE coalesce(product.active, true)
+        RETURN product, %s(chunkScore) AS score
+        UNION ALL
+        // Products stored before chunking, or whose chunks failed, only have
+        // their whole-product embedding
+        CALL db.index.vector.queryNodes('%s', $limit, $queryVector)
+        YIELD node AS product, score
+        WHERE coalesce(product.active, true) AND NOT EXISTS { (product)-[:HAS_CHUNK]->() }
+        RETURN product, score
+    }
+    WITH product, score
+    ORDER BY score DESC LIMIT $limit
+    WITH product, score
+    `, target.ChunkIndex, chunkCandidates, function, target.Index)
+}
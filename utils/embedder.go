@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+)
+
+const defaultEmbeddingDimension = 384
+
+// Embedder turns text into a vector for the product_text_embeddings index
+type Embedder interface {
+	// Model identifies the vectors produced, vectors of different models must not be mixed
+	Model() string
+	// Version tells apart the vectors of one model before and after a re-embed
+	Version() string
+	Embed(text string) ([]float64, error)
+}
+
+// APIEmbedder calls the HTTP embeddings service configured by EMBEDDINGS_API
+type APIEmbedder struct {
+	URL          string
+	ModelName    string
+	ModelVersion string
+}
+
+// HashEmbedder is a deterministic offline embedder that feature-hashes
+// sublinear term frequencies of words and word bigrams into Dimension buckets
+type HashEmbedder struct {
+	Dimension    int
+	ModelVersion string
+}
+
+var (
+	embedder         Embedder
+	embedderOnce     sync.Once
+	nextEmbedder     Embedder
+	nextEmbedderOnce sync.Once
+)
+
+// GetEmbedder returns the embedder selected by EMBEDDINGS_PROVIDER, either
+// "api" (default) or "hash" for development and tests without network access
+func GetEmbedder() Embedder {
+	embedderOnce.Do(func() {
+		embedder = GetEmbedderFromEnv("EMBEDDINGS_")
+	})
+	return embedder
+}
+
+// GetNextEmbedder returns the embedder configured with the EMBEDDINGS_NEXT_
+// settings that a re-embed job migrates products to, if any
+func GetNextEmbedder() (Embedder, bool) {
+	nextEmbedderOnce.Do(func() {
+		if os.Getenv("EMBEDDINGS_NEXT_PROVIDER") != "" || os.Getenv("EMBEDDINGS_NEXT_MODEL") != "" {
+			nextEmbedder = GetEmbedderFromEnv("EMBEDDINGS_NEXT_")
+		}
+	})
+	return nextEmbedder, nextEmbedder != nil
+}
+
+// GetEmbedderFromEnv builds an embedder from the PROVIDER, API, MODEL and
+// DIMENSION settings under prefix
+func GetEmbedderFromEnv(prefix string) Embedder {
+	switch os.Getenv(prefix + "PROVIDER") {
+	case "hash":
+		return HashEmbedder{Dimension: embeddingDimension(prefix), ModelVersion: embeddingVersion(prefix)}
+	default:
+		model := os.Getenv(prefix + "MODEL")
+		if model == "" {
+			model = "default"
+		}
+		return APIEmbedder{URL: os.Getenv(prefix + "API"), ModelName: model, ModelVersion: embeddingVersion(prefix)}
+	}
+}
+
+// EmbeddingModel returns the name of the configured embedding model
+func EmbeddingModel() string {
+	return GetEmbedder().Model()
+}
+
+// EmbeddingVersion returns EMBEDDINGS_MODEL_VERSION, "1" when unset
+func EmbeddingVersion() string {
+	return embeddingVersion("EMBEDDINGS_")
+}
+
+// NextEmbeddingVersion returns EMBEDDINGS_NEXT_MODEL_VERSION, "1" when unset
+func NextEmbeddingVersion() string {
+	return embeddingVersion("EMBEDDINGS_NEXT_")
+}
+
+func embeddingVersion(prefix string) string {
+	return versionOrDefault(os.Getenv(prefix + "MODEL_VERSION"))
+}
+
+func versionOrDefault(version string) string {
+	if version != "" {
+		return version
+	}
+	return "1"
+}
+
+// EmbeddingDimension returns EMBEDDINGS_DIMENSION or the default dimension
+func EmbeddingDimension() int {
+	return embeddingDimension("EMBEDDINGS_")
+}
+
+func embeddingDimension(prefix string) int {
+	if dimension, err := strconv.Atoi(os.Getenv(prefix + "DIMENSION")); err == nil && dimension > 0 {
+		return dimension
+	}
+	return defaultEmbeddingDimension
+}
+
+func (e APIEmbedder) Model() string {
+	return e.ModelName
+}
+
+func (e APIEmbedder) Version() string {
+	return versionOrDefault(e.ModelVersion)
+}
+
+func (e APIEmbedder) Embed(text string) ([]float64, error) {
+	resp, err := http.Get(e.URL + "?" + "text=" + url.QueryEscape(text))
+	if err != nil {
+		return nil, fmt.Errorf("embeddings request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embeddings request failed with status %d", resp.StatusCode)
+	}
+
+	var embeddingsresp types.EmbeddingResp
+	if err := json.NewDecoder(resp.Body).Decode(&embeddingsresp); err != nil {
+		return nil, fmt.Errorf("decoding embeddings response failed: %v", err)
+	}
+	return embeddingsresp.Embeddings, nil
+}
+
+func (e HashEmbedder) Model() string {
+	return fmt.Sprintf("hash-%d", e.Dimension)
+}
+
+func (e HashEmbedder) Version() string {
+	return versionOrDefault(e.ModelVersion)
+}
+
+func (e HashEmbedder) Embed(text string) ([]float64, error) {
+	if e.Dimension <= 0 {
+		return nil, fmt.Errorf("hash embedder dimension must be positive, got %d", e.Dimension)
+	}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	frequencies := map[string]int{}
+	for i, word := range words {
+		frequencies[word]++
+		if i > 0 {
+			frequencies[words[i-1]+" "+word]++
+		}
+	}
+
+	vector := make([]float64, e.Dimension)
+	for term, frequency := range frequencies {
+		h := fnv.New64a()
+		h.Write([]byte(term))
+		sum := h.Sum64()
+		weight := 1 + math.Log(float64(frequency))
+		if sum>>63 == 1 {
+			weight = -weight
+		}
+		vector[sum%uint64(e.Dimension)] += weight
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for i := range vector {
+			vector[i] /= norm
+		}
+	}
+	return vector, nil
+}
@@ -0,0 +1,263 @@
+package utils
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+const (
+	defaultEmbeddingCacheSize = 1000
+	// embeddingCacheNamespace changes whenever what keys are made of does, so
+	// entries keyed the old way are never served
+	embeddingCacheNamespace = "2"
+)
+
+// EmbeddingCache is an in-memory LRU of embeddings keyed on a hash of the
+// model, its version and normalized text, optionally backed by EmbeddingCache
+// nodes in Neo4j
+type EmbeddingCache struct {
+	mu         sync.Mutex
+	capacity   int
+	persistent bool
+	entries    map[string]*list.Element
+	order      *list.List
+	stats      EmbeddingCacheStats
+}
+
+// EmbeddingCacheStats holds the hit/miss counters of the embedding cache
+type EmbeddingCacheStats struct {
+	Hits           int  `json:"hits"`
+	PersistentHits int  `json:"persistent_hits"`
+	Misses         int  `json:"misses"`
+	Size           int  `json:"size"`
+	Capacity       int  `json:"capacity"`
+	Persistent     bool `json:"persistent"`
+}
+
+type embeddingCacheEntry struct {
+	key        string
+	embeddings []float64
+}
+
+var (
+	embeddingCache     *EmbeddingCache
+	embeddingCacheOnce sync.Once
+)
+
+// GetEmbeddingCache returns the process wide embedding cache, configured from
+// EMBEDDING_CACHE_SIZE and EMBEDDING_CACHE_STORE on first use
+func GetEmbeddingCache() *EmbeddingCache {
+	embeddingCacheOnce.Do(func() {
+		capacity := defaultEmbeddingCacheSize
+		if size, err := strconv.Atoi(os.Getenv("EMBEDDING_CACHE_SIZE")); err == nil {
+			capacity = size
+		}
+		embeddingCache = &EmbeddingCache{
+			capacity:   capacity,
+			persistent: os.Getenv("EMBEDDING_CACHE_STORE") == "neo4j",
+			entries:    map[string]*list.Element{},
+			order:      list.New(),
+		}
+	})
+	return embeddingCache
+}
+
+// NormalizeEmbeddingText lowercases the text and collapses runs of whitespace
+func NormalizeEmbeddingText(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+// EmbeddingCacheKey returns the content address of a normalized text for a
+// model version
+func EmbeddingCacheKey(model string, version string, normalizedText string) string {
+	sum := sha256.Sum256([]byte(embeddingCacheNamespace + "\x00" + model + "\x00" + version + "\x00" + normalizedText))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the cached embeddings for key, falling back to the persistent store
+func (ec *EmbeddingCache) Get(key string) ([]float64, bool) {
+	ec.mu.Lock()
+	if element, ok := ec.entries[key]; ok {
+		ec.order.MoveToFront(element)
+		ec.stats.Hits++
+		embeddings := element.Value.(*embeddingCacheEntry).embeddings
+		ec.mu.Unlock()
+		return embeddings, true
+	}
+	ec.mu.Unlock()
+
+	if ec.persistent {
+		embeddings, err := getPersistedEmbeddings(key)
+		if err != nil {
+			log.Printf("Error reading embedding cache: %s", err)
+		} else if len(embeddings) > 0 {
+			ec.mu.Lock()
+			ec.stats.PersistentHits++
+			ec.add(key, embeddings)
+			ec.mu.Unlock()
+			return embeddings, true
+		}
+	}
+
+	ec.mu.Lock()
+	ec.stats.Misses++
+	ec.mu.Unlock()
+	return nil, false
+}
+
+// Set stores the embeddings for key in memory and in the persistent store
+func (ec *EmbeddingCache) Set(key string, model string, version string, embeddings []float64) {
+	ec.mu.Lock()
+	ec.add(key, embeddings)
+	ec.mu.Unlock()
+	if ec.persistent {
+		if err := persistEmbeddings(key, model, version, embeddings); err != nil {
+			log.Printf("Error writing embedding cache: %s", err)
+		}
+	}
+}
+
+// add inserts an entry and evicts the least recently used ones, callers hold mu
+func (ec *EmbeddingCache) add(key string, embeddings []float64) {
+	if ec.capacity <= 0 {
+		return
+	}
+	if element, ok := ec.entries[key]; ok {
+		element.Value.(*embeddingCacheEntry).embeddings = embeddings
+		ec.order.MoveToFront(element)
+		return
+	}
+	ec.entries[key] = ec.order.PushFront(&embeddingCacheEntry{key: key, embeddings: embeddings})
+	for ec.order.Len() > ec.capacity {
+		oldest := ec.order.Back()
+		ec.order.Remove(oldest)
+		delete(ec.entries, oldest.Value.(*embeddingCacheEntry).key)
+	}
+}
+
+// Stats returns a snapshot of the cache counters
+func (ec *EmbeddingCache) Stats() EmbeddingCacheStats {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	stats := ec.stats
+	stats.Size = ec.order.Len()
+	stats.Capacity = ec.capacity
+	stats.Persistent = ec.persistent
+	return stats
+}
+
+// Purge empties the in-memory cache and the persistent store, returning the
+// number of persisted entries removed
+func (ec *EmbeddingCache) Purge() (int, error) {
+	ec.mu.Lock()
+	ec.entries = map[string]*list.Element{}
+	ec.order.Init()
+	ec.stats = EmbeddingCacheStats{}
+	ec.mu.Unlock()
+	if !ec.persistent {
+		return 0, nil
+	}
+	return PurgePersistedEmbeddings()
+}
+
+func getPersistedEmbeddings(key string) ([]float64, error) {
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		return nil, err
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	query := `MATCH (e:EmbeddingCache {key: $key}) RETURN e.embeddings AS embeddings`
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"key": key})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return nil, nil
+	}
+	values, _ := records[0].Get("embeddings")
+	raw, ok := values.([]any)
+	if !ok {
+		return nil, fmt.Errorf("cached embeddings for %s have unexpected type %T", key, values)
+	}
+	embeddings := make([]float64, len(raw))
+	for i, v := range raw {
+		embeddings[i], _ = v.(float64)
+	}
+	return embeddings, nil
+}
+
+func persistEmbeddings(key string, model string, version string, embeddings []float64) error {
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		return err
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	query := `MERGE (e:EmbeddingCache {key: $key})
+        ON CREATE SET e.created_at = datetime()
+        SET e.model = $model, e.version = $version, e.embeddings = $embeddings`
+	params := map[string]any{
+		"key":        key,
+		"model":      model,
+		"version":    version,
+		"embeddings": embeddings,
+	}
+	_, err = session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			return tx.Run(ctx, query, params)
+		})
+	return err
+}
+
+// PurgePersistedEmbeddings deletes every EmbeddingCache node
+func PurgePersistedEmbeddings() (int, error) {
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		return 0, err
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	query := `MATCH (e:EmbeddingCache) DETACH DELETE e RETURN count(e) AS purged`
+	purged, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, nil)
+			if err != nil {
+				return nil, err
+			}
+			record, err := result.Single(ctx)
+			if err != nil {
+				return nil, err
+			}
+			count, _ := record.Get("purged")
+			return count, nil
+		})
+	if err != nil {
+		return 0, err
+	}
+	return int(purged.(int64)), nil
+}
@@ -0,0 +1,316 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+const (
+	defaultEmbeddingProperty = "textEmbedding"
+	defaultEmbeddingIndex    = "product_text_embeddings"
+)
+
+var nonIdentifierPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+// EmbeddingTarget is the Product/ProductChunk property and the vector indexes
+// holding the embeddings of one model version
+type EmbeddingTarget struct {
+	Model      string `json:"model"`
+	Version    string `json:"version"`
+	Property   string `json:"property"`
+	Index      string `json:"index"`
+	ChunkIndex string `json:"chunk_index"`
+}
+
+// TargetEmbedder pairs an embedding target with the embedder producing its vectors
+type TargetEmbedder struct {
+	Target   EmbeddingTarget
+	Embedder Embedder
+}
+
+// DefaultEmbeddingTarget is where the configured model stores its vectors
+// until a re-embed job has been switched over
+func DefaultEmbeddingTarget() EmbeddingTarget {
+	return EmbeddingTarget{
+		Model:      EmbeddingModel(),
+		Version:    EmbeddingVersion(),
+		Property:   defaultEmbeddingProperty,
+		Index:      defaultEmbeddingIndex,
+		ChunkIndex: ProductChunkIndex,
+	}
+}
+
+// NewEmbeddingTarget names the side-by-side property and indexes of a model version
+func NewEmbeddingTarget(model string, version string) EmbeddingTarget {
+	slug := strings.Trim(nonIdentifierPattern.ReplaceAllString(strings.ToLower(model+"_"+version), "_"), "_")
+	return EmbeddingTarget{
+		Model:      model,
+		Version:    version,
+		Property:   defaultEmbeddingProperty + "_" + slug,
+		Index:      defaultEmbeddingIndex + "_" + slug,
+		ChunkIndex: ProductChunkIndex + "_" + slug,
+	}
+}
+
+// EmbeddingSimilarity returns the vector index similarity function from
+// EMBEDDINGS_SIMILARITY, cosine by default
+func EmbeddingSimilarity() string {
+	if os.Getenv("EMBEDDINGS_SIMILARITY") == "euclidean" {
+		return "euclidean"
+	}
+	return "cosine"
+}
+
+// GetEmbeddingTargets returns the active target searched by recommendations
+// and, while a re-embed job is building one, the next target
+func GetEmbeddingTargets(ctx context.Context, session neo4j.SessionWithContext) (EmbeddingTarget, *EmbeddingTarget, error) {
+	query := `MATCH (c:EmbeddingConfig {name: "product"}) RETURN c {.*} AS config`
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, nil)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return EmbeddingTarget{}, nil, err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return DefaultEmbeddingTarget(), nil, nil
+	}
+	value, _ := records[0].Get("config")
+	config, _ := value.(map[string]any)
+	active := embeddingTargetFromConfig(config, "active_")
+	if active.Property == "" {
+		active = DefaultEmbeddingTarget()
+	}
+	var next *EmbeddingTarget
+	if target := embeddingTargetFromConfig(config, "next_"); target.Property != "" {
+		next = &target
+	}
+	return active, next, nil
+}
+
+func embeddingTargetFromConfig(config map[string]any, prefix string) EmbeddingTarget {
+	field := func(name string) string {
+		value, _ := config[prefix+name].(string)
+		return value
+	}
+	return EmbeddingTarget{
+		Model:      field("model"),
+		Version:    field("version"),
+		Property:   field("property"),
+		Index:      field("index"),
+		ChunkIndex: field("chunk_index"),
+	}
+}
+
+// EmbedderFor returns the configured embedder, current or next, that produces
+// the vectors of target
+func EmbedderFor(target EmbeddingTarget) (Embedder, error) {
+	if current := GetEmbedder(); current.Model() == target.Model && current.Version() == target.Version {
+		return current, nil
+	}
+	if next, ok := GetNextEmbedder(); ok && next.Model() == target.Model && next.Version() == target.Version {
+		return next, nil
+	}
+	return nil, fmt.Errorf("no embedder is configured for model %s version %s", target.Model, target.Version)
+}
+
+// GetQueryEmbeddings embeds a search text with the model of the active target
+func GetQueryEmbeddings(ctx context.Context, session neo4j.SessionWithContext, text string) ([]float64, EmbeddingTarget, error) {
+	active, _, err := GetEmbeddingTargets(ctx, session)
+	if err != nil {
+		return nil, active, err
+	}
+	embedder, err := EmbedderFor(active)
+	if err != nil {
+		return nil, active, err
+	}
+	embeddings, err := EmbedWith(embedder, text)
+	return embeddings, active, err
+}
+
+// embeddingWriteTargets returns the targets that new embeddings are written
+// to: the active one and, during a re-embed, the next one
+func embeddingWriteTargets(ctx context.Context, session neo4j.SessionWithContext) ([]TargetEmbedder, error) {
+	active, next, err := GetEmbeddingTargets(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	targets := []EmbeddingTarget{active}
+	if next != nil {
+		targets = append(targets, *next)
+	}
+	var writeTargets []TargetEmbedder
+	for _, target := range targets {
+		embedder, err := EmbedderFor(target)
+		if err != nil {
+			return nil, err
+		}
+		writeTargets = append(writeTargets, TargetEmbedder{Target: target, Embedder: embedder})
+	}
+	return writeTargets, nil
+}
+
+// embedForTargets returns the vectors of text keyed by each target's property
+func embedForTargets(targets []TargetEmbedder, text string) (map[string]any, error) {
+	properties := map[string]any{}
+	for _, te := range targets {
+		embeddings, err := EmbedWith(te.Embedder, text)
+		if err != nil {
+			return nil, err
+		}
+		properties[te.Target.Property] = embeddings
+	}
+	return properties, nil
+}
+
+// ProductEmbeddingProperties returns the properties to SET on a Product for
+// text: a vector per write target plus the active embedding model and version
+func ProductEmbeddingProperties(ctx context.Context, session neo4j.SessionWithContext, text string) (map[string]any, error) {
+	targets, err := embeddingWriteTargets(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	return productEmbeddings(targets, text)
+}
+
+// productEmbeddings returns the vectors of text for targets plus the model and
+// version of the first, active, target
+func productEmbeddings(targets []TargetEmbedder, text string) (map[string]any, error) {
+	properties, err := embedForTargets(targets, text)
+	if err != nil {
+		return nil, err
+	}
+	properties["embedding_model"] = targets[0].Target.Model
+	properties["embedding_version"] = targets[0].Target.Version
+	return properties, nil
+}
+
+// VectorIndexStatements returns the Cypher creating the product and chunk
+// vector indexes of target
+func VectorIndexStatements(target EmbeddingTarget, dimension int) []string {
+	return []string{
+		fmt.Sprintf("CREATE VECTOR INDEX %s IF NOT EXISTS FOR (p:Product) ON (p.%s) OPTIONS {indexConfig: {`vector.dimensions`: %d, `vector.similarity_function`: '%s'}}",
+			target.Index, target.Property, dimension, EmbeddingSimilarity()),
+		fmt.Sprintf("CREATE VECTOR INDEX %s IF NOT EXISTS FOR (c:ProductChunk) ON (c.%s) OPTIONS {indexConfig: {`vector.dimensions`: %d, `vector.similarity_function`: '%s'}}",
+			target.ChunkIndex, target.Property, dimension, EmbeddingSimilarity()),
+	}
+}
+
+// CreateVectorIndexes creates the product and chunk vector indexes of target
+func CreateVectorIndexes(ctx context.Context, session neo4j.SessionWithContext, target EmbeddingTarget, dimension int) error {
+	for _, statement := range VectorIndexStatements(target, dimension) {
+		_, err := session.ExecuteWrite(ctx,
+			func(tx neo4j.ManagedTransaction) (any, error) {
+				result, err := tx.Run(ctx, statement, nil)
+				if err != nil {
+					return nil, err
+				}
+				return result.Consume(ctx)
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetNextEmbeddingTarget records the target a re-embed job is building so
+// that ingestion also writes to it
+func SetNextEmbeddingTarget(ctx context.Context, session neo4j.SessionWithContext, target EmbeddingTarget) error {
+	active := DefaultEmbeddingTarget()
+	query := `
+    MERGE (c:EmbeddingConfig {name: "product"})
+    ON CREATE SET c.active_model = $active.model, c.active_version = $active.version,
+        c.active_property = $active.property, c.active_index = $active.index,
+        c.active_chunk_index = $active.chunk_index
+    SET c.next_model = $next.model, c.next_version = $next.version,
+        c.next_property = $next.property, c.next_index = $next.index,
+        c.next_chunk_index = $next.chunk_index
+    `
+	params := map[string]any{
+		"active": embeddingTargetParams(active),
+		"next":   embeddingTargetParams(target),
+	}
+	_, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return err
+}
+
+// SwitchEmbeddingTarget makes the next target active in a single transaction.
+// Unless force is set it refuses while products are still missing next
+// vectors, returning why in conflict
+func SwitchEmbeddingTarget(ctx context.Context, session neo4j.SessionWithContext, force bool) (EmbeddingTarget, string, error) {
+	_, next, err := GetEmbeddingTargets(ctx, session)
+	if err != nil {
+		return EmbeddingTarget{}, "", err
+	}
+	if next == nil {
+		return EmbeddingTarget{}, "no re-embedded target to switch to", nil
+	}
+	params := map[string]any{"next": embeddingTargetParams(*next)}
+	var conflict string
+	_, err = session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			countQuery := fmt.Sprintf("MATCH (p:Product) WHERE p.%s IS NULL RETURN count(p) AS remaining", next.Property)
+			result, err := tx.Run(ctx, countQuery, nil)
+			if err != nil {
+				return nil, err
+			}
+			record, err := result.Single(ctx)
+			if err != nil {
+				return nil, err
+			}
+			remaining, _ := record.Get("remaining")
+			if remaining.(int64) > 0 && !force {
+				conflict = fmt.Sprintf("%d products have not been re-embedded yet", remaining)
+				return nil, nil
+			}
+			switchQuery := fmt.Sprintf(`
+            MATCH (c:EmbeddingConfig {name: "product"})
+            SET c.active_model = $next.model, c.active_version = $next.version,
+                c.active_property = $next.property, c.active_index = $next.index,
+                c.active_chunk_index = $next.chunk_index,
+                c.next_model = null, c.next_version = null, c.next_property = null,
+                c.next_index = null, c.next_chunk_index = null,
+                c.switched_at = datetime()
+            WITH c
+            MATCH (p:Product) WHERE p.%s IS NOT NULL
+            SET p.embedding_model = $next.model, p.embedding_version = $next.version
+            `, next.Property)
+			result, err = tx.Run(ctx, switchQuery, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	if err != nil || conflict != "" {
+		return EmbeddingTarget{}, conflict, err
+	}
+	return *next, "", nil
+}
+
+func embeddingTargetParams(target EmbeddingTarget) map[string]any {
+	return map[string]any{
+		"model":       target.Model,
+		"version":     target.Version,
+		"property":    target.Property,
+		"index":       target.Index,
+		"chunk_index": target.ChunkIndex,
+	}
+}
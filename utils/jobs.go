@@ -0,0 +1,365 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+const (
+	defaultIngestionWorkers   = 2
+	defaultIngestionQueueSize = 100
+	// maxIngestionJobErrors bounds the per-product errors kept on a job
+	maxIngestionJobErrors = 100
+	// ingestionProgressEvery is how many products are processed between
+	// saves of a job's progress
+	ingestionProgressEvery = 50
+)
+
+// ProductError is why one product of an ingestion job failed
+type ProductError struct {
+	ExternalID int    `json:"external_id"`
+	Error      string `json:"error"`
+}
+
+// IngestionJob is a catalog sync of a site run by the ingestion workers,
+// persisted on an IngestionJob node so queued and interrupted jobs are
+// resumed when the server restarts
+type IngestionJob struct {
+	ID         string         `json:"id"`
+	SiteID     string         `json:"site_id"`
+	Mode       string         `json:"mode"`
+	Status     string         `json:"status"`
+	Processed  int            `json:"processed"`
+	Counts     UpsertCounts   `json:"counts"`
+	Errors     []ProductError `json:"errors"`
+	ErrorCount int            `json:"error_count"`
+	Error      string         `json:"error,omitempty"`
+	SyncRunID  string         `json:"sync_run_id,omitempty"`
+	CreatedAt  string         `json:"created_at"`
+	StartedAt  string         `json:"started_at,omitempty"`
+	FinishedAt string         `json:"finished_at,omitempty"`
+}
+
+var (
+	ingestionQueue     chan string
+	ingestionQueueOnce sync.Once
+)
+
+func getIngestionQueue() chan string {
+	ingestionQueueOnce.Do(func() {
+		size := defaultIngestionQueueSize
+		if value, err := strconv.Atoi(os.Getenv("INGESTION_QUEUE_SIZE")); err == nil && value > 0 {
+			size = value
+		}
+		ingestionQueue = make(chan string, size)
+	})
+	return ingestionQueue
+}
+
+// StartIngestionWorkers starts INGESTION_WORKERS (default 2) workers and
+// requeues the jobs left queued or running by a previous process. Re-running
+// an interrupted sync is cheap since unchanged products are skipped
+func StartIngestionWorkers(ctx context.Context) {
+	workers := defaultIngestionWorkers
+	if value, err := strconv.Atoi(os.Getenv("INGESTION_WORKERS")); err == nil && value > 0 {
+		workers = value
+	}
+	queue := getIngestionQueue()
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-queue:
+					runIngestionJob(ctx, id)
+				}
+			}
+		}()
+	}
+
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		log.Printf("Could not resume ingestion jobs: %v", err)
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	query := `
+    MATCH (j:IngestionJob) WHERE j.status IN ["queued", "running"]
+    SET j.status = "queued"
+    RETURN j.id AS id ORDER BY j.created_at
+    `
+	result, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, nil)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		log.Printf("Could not resume ingestion jobs: %v", err)
+		return
+	}
+	var pending []string
+	for _, record := range result.([]*neo4j.Record) {
+		id, _ := record.Get("id")
+		pending = append(pending, id.(string))
+	}
+	if len(pending) > 0 {
+		log.Printf("Resuming %d ingestion jobs", len(pending))
+		// More jobs than the queue holds wait here rather than being dropped
+		go func() {
+			for _, id := range pending {
+				queue <- id
+			}
+		}()
+	}
+}
+
+// SubmitIngestionJob queues a sync of a site. A site with a job already
+// queued or running gets that job back instead of a second one. found is
+// false when siteID is not a site
+func SubmitIngestionJob(ctx context.Context, session neo4j.SessionWithContext, siteID string, mode string) (IngestionJob, bool, error) {
+	pendingQuery := `
+    MATCH (j:IngestionJob {site_id: $site_id}) WHERE j.status IN ["queued", "running"]
+    RETURN j.id AS id LIMIT 1
+    `
+	createQuery := `
+    MATCH (s:Site {id: $site_id})
+    CREATE (j:IngestionJob {id: $id, site_id: $site_id, mode: $mode, status: "queued",
+        processed: 0, created: 0, updated: 0, unchanged: 0, failed: 0,
+        errors: "[]", error_count: 0, created_at: datetime()})
+    CREATE (j)-[:INGESTS]->(s)
+    RETURN j.id AS id
+    `
+	params := map[string]any{"site_id": siteID, "id": NewID(), "mode": mode}
+	created := false
+	result, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			created = false
+			result, err := tx.Run(ctx, pendingQuery, params)
+			if err != nil {
+				return nil, err
+			}
+			records, err := result.Collect(ctx)
+			if err != nil || len(records) > 0 {
+				return records, err
+			}
+			result, err = tx.Run(ctx, createQuery, params)
+			if err != nil {
+				return nil, err
+			}
+			created = true
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return IngestionJob{}, false, err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return IngestionJob{}, false, nil
+	}
+	id, _ := records[0].Get("id")
+	if created {
+		select {
+		case getIngestionQueue() <- id.(string):
+		default:
+			if err := finishIngestionJob(ctx, session, id.(string), "failed", "ingestion queue is full"); err != nil {
+				return IngestionJob{}, true, err
+			}
+			return IngestionJob{}, true, fmt.Errorf("ingestion queue is full")
+		}
+	}
+	job, _, err := GetIngestionJob(ctx, session, id.(string))
+	return job, true, err
+}
+
+// GetIngestionJob returns the stored progress of an ingestion job
+func GetIngestionJob(ctx context.Context, session neo4j.SessionWithContext, id string) (IngestionJob, bool, error) {
+	query := `
+    MATCH (j:IngestionJob {id: $id})
+    RETURN j {.*, created_at: toString(j.created_at), started_at: toString(j.started_at),
+        finished_at: toString(j.finished_at)} AS job
+    `
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"id": id})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return IngestionJob{}, false, err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return IngestionJob{}, false, nil
+	}
+	value, _ := records[0].Get("job")
+	values := value.(map[string]any)
+	text := func(key string) string {
+		value, _ := values[key].(string)
+		return value
+	}
+	number := func(key string) int {
+		value, _ := values[key].(int64)
+		return int(value)
+	}
+	job := IngestionJob{
+		ID:         text("id"),
+		SiteID:     text("site_id"),
+		Mode:       text("mode"),
+		Status:     text("status"),
+		Processed:  number("processed"),
+		ErrorCount: number("error_count"),
+		Error:      text("error"),
+		SyncRunID:  text("sync_run_id"),
+		CreatedAt:  text("created_at"),
+		StartedAt:  text("started_at"),
+		FinishedAt: text("finished_at"),
+		Counts: UpsertCounts{
+			Created:   number("created"),
+			Updated:   number("updated"),
+			Unchanged: number("unchanged"),
+			Failed:    number("failed"),
+		},
+		Errors: []ProductError{},
+	}
+	if err := json.Unmarshal([]byte(text("errors")), &job.Errors); err != nil {
+		job.Errors = []ProductError{}
+	}
+	return job, true, nil
+}
+
+func runIngestionJob(ctx context.Context, id string) {
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		log.Printf("Ingestion job %s could not connect to Neo4j: %v", id, err)
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+
+	job, found, err := GetIngestionJob(ctx, session, id)
+	if err != nil || !found {
+		log.Printf("Ingestion job %s could not be loaded: %v", id, err)
+		return
+	}
+	// A resumed job starts over, so its progress is reset with it
+	job.Status = "running"
+	job.Processed, job.Counts = 0, UpsertCounts{}
+	job.Errors, job.ErrorCount = []ProductError{}, 0
+	job.StartedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := saveIngestionJob(ctx, session, job); err != nil {
+		log.Printf("Ingestion job %s could not be started: %v", id, err)
+		return
+	}
+
+	// Progress is saved from the sync's pipeline goroutines, so it gets its own
+	// session rather than sharing the one the sync uses
+	progressSession := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer progressSession.Close(ctx)
+	var mu sync.Mutex
+	report := func(externalID int, outcome string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		job.Processed++
+		if err != nil {
+			job.Counts.Failed++
+			job.ErrorCount++
+			if len(job.Errors) < maxIngestionJobErrors {
+				job.Errors = append(job.Errors, ProductError{ExternalID: externalID, Error: err.Error()})
+			}
+		} else {
+			job.Counts.Add(outcome)
+		}
+		if job.Processed%ingestionProgressEvery == 0 {
+			if err := saveIngestionJob(ctx, progressSession, job); err != nil {
+				log.Printf("Ingestion job %s could not save progress: %v", id, err)
+			}
+		}
+	}
+	run, err := RunSiteSync(ctx, session, job.SiteID, job.Mode, report)
+
+	mu.Lock()
+	defer mu.Unlock()
+	job.SyncRunID = run.ID
+	job.Status = "succeeded"
+	if err != nil {
+		job.Status = "failed"
+		job.Error = err.Error()
+	}
+	if err := saveIngestionJob(ctx, session, job); err != nil {
+		log.Printf("Ingestion job %s could not save progress: %v", id, err)
+	}
+	if err := finishIngestionJob(ctx, session, id, job.Status, job.Error); err != nil {
+		log.Printf("Ingestion job %s could not be finished: %v", id, err)
+	}
+}
+
+func saveIngestionJob(ctx context.Context, session neo4j.SessionWithContext, job IngestionJob) error {
+	errors, err := json.Marshal(job.Errors)
+	if err != nil {
+		return err
+	}
+	query := `
+    MATCH (j:IngestionJob {id: $id})
+    SET j.status = $status, j.processed = $processed,
+        j.created = $created, j.updated = $updated, j.unchanged = $unchanged, j.failed = $failed,
+        j.errors = $errors, j.error_count = $error_count, j.sync_run_id = $sync_run_id,
+        j.started_at = datetime($started_at)
+    `
+	params := map[string]any{
+		"id":          job.ID,
+		"status":      job.Status,
+		"processed":   job.Processed,
+		"created":     job.Counts.Created,
+		"updated":     job.Counts.Updated,
+		"unchanged":   job.Counts.Unchanged,
+		"failed":      job.Counts.Failed,
+		"errors":      string(errors),
+		"error_count": job.ErrorCount,
+		"sync_run_id": job.SyncRunID,
+		"started_at":  job.StartedAt,
+	}
+	_, err = session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return err
+}
+
+func finishIngestionJob(ctx context.Context, session neo4j.SessionWithContext, id string, status string, message string) error {
+	query := `
+    MATCH (j:IngestionJob {id: $id})
+    SET j.status = $status, j.finished_at = datetime(),
+        j.error = CASE WHEN $error = "" THEN null ELSE $error END
+    `
+	params := map[string]any{"id": id, "status": status, "error": message}
+	_, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return err
+}
@@ -2,18 +2,13 @@ package utils
 
 import (
 	"context"
-	"database/sql"
-	"encoding/json"
 	"fmt"
-	"net/http"
-	"net/url"
 	"os"
 	"time"
 
 	"crypto/rand"
 	"encoding/hex"
 
-	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/jackc/pgx/v5"
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
@@ -95,70 +90,42 @@ func ParseDate(date time.Time) (int, int, int) {
 
 // getUserDataFromPg returns the user data from the database
 func GetUserDataFromPg(id int) map[string]interface{} {
-	host := os.Getenv("POSTGRES_HOST")
-	password := os.Getenv("POSTGRES_PASSWORD")
-	username := os.Getenv("POSTGRES_USER")
-	port := os.Getenv("POSTGRES_PORT")
-	database := os.Getenv("POSTGRES_DB")
-	db_url := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", username, password, host, port, database)
-	conn, err := pgx.Connect(context.Background(), db_url)
+	data, err := getUserDataFromPg(`WHERE id = $1`, id)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to connect to database: %v\n", err)
+		fmt.Fprintf(os.Stderr, "User QueryRow failed: %v\n", err)
 		os.Exit(1)
 	}
-	defer conn.Close(context.Background())
-	var user_id int
-	var email string
-	var name string
-	var gender string
-	var date_of_birth time.Time
-	var latitude float64
-	var longitude float64
-	var allergy string
-	query := `SELECT
-    id,
-    COALESCE(email, 'default_email@example.com') AS email,
-    COALESCE(name, 'Unknown') AS name,
-    COALESCE(gender, 'Unknown') AS gender,
-    COALESCE(date_of_birth, '1000-01-01') AS date_of_birth,
-    COALESCE(latitude, 0.0) AS latitude,
-    COALESCE(longitude, 0.0) AS longitude
-    FROM users
-    WHERE email = $1;`
-	err = conn.QueryRow(context.Background(), query, email).
-		Scan(&user_id, &email, &name, &gender, &date_of_birth, &latitude, &longitude)
+	return data
+}
+
+func GetUserDataFromPgV2(email string) map[string]interface{} {
+	data, err := getUserDataFromPg(`WHERE email = $1`, email)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "User QueryRow failed: %v\n", err)
 		os.Exit(1)
 	}
-	allergy_query := "select COALESCE(name, 'Unknown') from allergies where user_id=$1"
-	allergy_err := conn.QueryRow(context.Background(), allergy_query, id).Scan(&allergy)
-	if allergy_err != nil {
-		if allergy_err == sql.ErrNoRows {
-			allergy = ""
-		} else {
-			allergy = ""
-		}
+	return data
+}
+
+// GetUserDataFromPgByIc returns the profile and allergies of the patient with
+// an IC/passport number, in the shape StoreUserData takes
+func GetUserDataFromPgByIc(ic_passport string) (map[string]interface{}, error) {
+	if ic_passport == "" {
+		return nil, fmt.Errorf("ic_passport is required")
 	}
-	age := int(time.Since(date_of_birth).Hours() / 24 / 365)
-	year, month, day := ParseDate(date_of_birth)
-	data := map[string]interface{}{
-		"id":        user_id,
-		"email":     email,
-		"name":      name,
-		"age":       age,
-		"gender":    gender,
-		"latitude":  latitude,
-		"longitude": longitude,
-		"allergy":   allergy,
-		"year":      year,
-		"month":     month,
-		"day":       day,
+	return getUserDataFromPg(`WHERE ic = $1`, ic_passport)
+}
+
+// GetUserDataFromPgByEmail returns the profile and allergies of the patient
+// with an email, in the shape StoreUserData takes
+func GetUserDataFromPgByEmail(email string) (map[string]interface{}, error) {
+	if email == "" {
+		return nil, fmt.Errorf("email is required")
 	}
-	return data
+	return getUserDataFromPg(`WHERE email = $1`, email)
 }
 
-func GetUserDataFromPgV2(email string) map[string]interface{} {
+func getUserDataFromPg(where string, value any) (map[string]interface{}, error) {
 	host := os.Getenv("POSTGRES_HOST")
 	password := os.Getenv("POSTGRES_PASSWORD")
 	username := os.Getenv("POSTGRES_USER")
@@ -167,19 +134,20 @@ func GetUserDataFromPgV2(email string) map[string]interface{} {
 	db_url := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", username, password, host, port, database)
 	conn, err := pgx.Connect(context.Background(), db_url)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to connect to database: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("unable to connect to database: %v", err)
 	}
 	defer conn.Close(context.Background())
 	var user_id int
+	var ic_passport string
+	var email string
 	var name string
 	var gender string
 	var date_of_birth time.Time
 	var latitude float64
 	var longitude float64
-	var allergy string
 	query := `SELECT
     id,
+    COALESCE(ic, '') AS ic,
     COALESCE(email, 'default_email@example.com') AS email,
     COALESCE(name, 'Unknown') AS name,
     COALESCE(gender, 'Unknown') AS gender,
@@ -187,29 +155,38 @@ func GetUserDataFromPgV2(email string) map[string]interface{} {
     COALESCE(latitude, 0.0) AS latitude,
     COALESCE(longitude, 0.0) AS longitude
     FROM users
-    WHERE email = $1;`
-	err = conn.QueryRow(context.Background(), query, email).
-		Scan(&user_id, &email, &name, &gender, &date_of_birth, &latitude, &longitude)
+    ` + where + `;`
+	err = conn.QueryRow(context.Background(), query, value).
+		Scan(&user_id, &ic_passport, &email, &name, &gender, &date_of_birth, &latitude, &longitude)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "User QueryRow failed: %v\n", err)
-		os.Exit(1)
+		return nil, err
+	}
+	// A patient has any number of allergies, one row each
+	rows, err := conn.Query(context.Background(), `SELECT DISTINCT TRIM(name) FROM allergies WHERE user_id = $1 AND TRIM(COALESCE(name, '')) <> ''`, user_id)
+	if err != nil {
+		return nil, err
+	}
+	allergies, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
 	}
 	age := int(time.Since(date_of_birth).Hours() / 24 / 365)
 	year, month, day := ParseDate(date_of_birth)
 	data := map[string]interface{}{
-		"id":        user_id,
-		"email":     email,
-		"name":      name,
-		"age":       age,
-		"gender":    gender,
-		"latitude":  latitude,
-		"longitude": longitude,
-		"allergy":   allergy,
-		"year":      year,
-		"month":     month,
-		"day":       day,
+		"id":          user_id,
+		"ic_passport": ic_passport,
+		"email":       email,
+		"name":        name,
+		"age":         age,
+		"gender":      gender,
+		"latitude":    latitude,
+		"longitude":   longitude,
+		"allergies":   allergies,
+		"year":        year,
+		"month":       month,
+		"day":         day,
 	}
-	return data
+	return data, nil
 }
 
 func GetUserDiagnosisFromIc(ic_passport string, n_diagnosis int) ([]string, error) {
@@ -248,7 +225,9 @@ func GetUserDiagnosisFromIc(ic_passport string, n_diagnosis int) ([]string, erro
 	return diagnoses, nil
 }
 
-func GetUserDiagnosisFromEmail(email string) ([]string, error) {
+// GetUserDiagnosisFromEmail returns the latest n_diagnosis diagnoses of the
+// patient with an email
+func GetUserDiagnosisFromEmail(email string, n_diagnosis int) ([]string, error) {
 	host := os.Getenv("POSTGRES_HOST")
 	password := os.Getenv("POSTGRES_PASSWORD")
 	username := os.Getenv("POSTGRES_USER")
@@ -265,8 +244,8 @@ func GetUserDiagnosisFromEmail(email string) ([]string, error) {
   FROM consultations c
   JOIN users u ON c.user_id = u.id
   WHERE u.email = $1
-  ORDER BY c.created_at DESC LIMIT 3;`
-	rows, err := conn.Query(context.Background(), query, email)
+  ORDER BY c.created_at DESC LIMIT $2;`
+	rows, err := conn.Query(context.Background(), query, email, n_diagnosis)
 	if err != nil {
 		return nil, fmt.Errorf("query execution failed: %v", err)
 	}
@@ -316,6 +295,8 @@ func CheckIfUserExistsInNeo4J(ic_passport string) bool {
 	}
 }
 
+// StoreUserData merges a patient loaded from Postgres, linking them to the
+// shared Allergens node of each of their allergies and to their Gender
 func StoreUserData(userData map[string]interface{}) []map[string]interface{} {
 	ctx := context.Background()
 	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
@@ -327,13 +308,39 @@ func StoreUserData(userData map[string]interface{}) []map[string]interface{} {
 	defer session.Close(ctx)
 	query :=
 		`
-    CREATE(u:User {id: $id, name: $name, age: $age, email: $email, latitude: $latitude, longitude: $longitude,
-    dob: date({year: $year, month: $month, day: $day})}),
-    (u)-[:HAS_ALLERGY]->(a: Allergens {type: $allergy}), (u)-[:GENDER]->(g: Gender {type: $gender}) return u, a, g
+    MERGE (u:User {id: $id})
+    SET u.name = $name, u.age = $age, u.email = $email, u.latitude = $latitude, u.longitude = $longitude,
+        u.ic_passport = CASE WHEN $ic_passport = "" THEN u.ic_passport ELSE $ic_passport END,
+        u.dob = date({year: $year, month: $month, day: $day})
+    WITH u
+    OPTIONAL MATCH (u)-[old:HAS_ALLERGY|GENDER]->()
+    DELETE old
+    WITH DISTINCT u
+    CALL {
+        WITH u
+        UNWIND $allergies AS allergy
+        MERGE (a:Allergens {key: allergy.key})
+        ON CREATE SET a.type = allergy.type
+        MERGE (u)-[:HAS_ALLERGY]->(a)
+    }
+    MERGE (g:Gender {key: toLower($gender)})
+    ON CREATE SET g.type = $gender
+    MERGE (u)-[:GENDER]->(g)
+    RETURN u, COLLECT { MATCH (u)-[:HAS_ALLERGY]->(a:Allergens) RETURN a.type } AS allergies, g
     `
+	params := map[string]interface{}{"ic_passport": ""}
+	for key, value := range userData {
+		params[key] = value
+	}
+	// Allergies and gender link to the shared reference nodes of their canonical name
+	allergies, _ := userData["allergies"].([]string)
+	if params["allergies"], err = ResolveAllergens(ctx, session, allergies); err != nil {
+		return []map[string]interface{}{}
+	}
+	params["gender"] = CanonicalGender(fmt.Sprint(userData["gender"]))
 	results, _ := session.ExecuteWrite(ctx,
 		func(tx neo4j.ManagedTransaction) (any, error) {
-			result, _ := tx.Run(ctx, query, userData)
+			result, _ := tx.Run(ctx, query, params)
 			records, _ := result.Collect(ctx)
 			return records, nil
 		})
@@ -344,24 +351,36 @@ func StoreUserData(userData map[string]interface{}) []map[string]interface{} {
 	return persons
 }
 
-// getEmbeddings returns the embeddings of a text
+// getEmbeddings returns the embeddings of a text, served from the embedding
+// cache when the same model has already embedded the normalized text
 func GetEmbeddings(text string) []float64 {
-	embeddings_api := os.Getenv("EMBEDDINGS_API")
-	url := embeddings_api + "?" + "text=" + url.QueryEscape(text)
-	resp, err := http.Get(url)
+	embeddings, err := EmbedWith(GetEmbedder(), text)
 	if err != nil {
-		fmt.Println("Error creating request:", err)
+		fmt.Println("Error getting embeddings:", err)
 		os.Exit(1)
 	}
-	defer resp.Body.Close()
+	return embeddings
+}
 
-	var embeddingsresp types.EmbeddingResp
-	err = json.NewDecoder(resp.Body).Decode(&embeddingsresp)
+// EmbedWith returns the embeddings of a text produced by embedder, served
+// from the embedding cache when available. Only the cache key is normalized,
+// the embedder gets the text as it is
+func EmbedWith(embedder Embedder, text string) ([]float64, error) {
+	model, version := embedder.Model(), embedder.Version()
+	key := EmbeddingCacheKey(model, version, NormalizeEmbeddingText(text))
+	cache := GetEmbeddingCache()
+	if embeddings, ok := cache.Get(key); ok {
+		return embeddings, nil
+	}
+	embeddings, err := embedder.Embed(text)
 	if err != nil {
-		fmt.Println("Error decoding response:", err)
-		os.Exit(1)
+		return nil, err
+	}
+	if len(embeddings) == 0 {
+		return nil, fmt.Errorf("%s returned no embeddings", model)
 	}
-	return embeddingsresp.Embeddings
+	cache.Set(key, model, version, embeddings)
+	return embeddings, nil
 }
 
 func GenerateRandomHex(n int) (string, error) {
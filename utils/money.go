@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"context"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// priceKeys are the properties holding prices in minor units
+var priceKeys = []string{"price", "regular_price", "sale_price"}
+
+// GetSiteCurrency returns the currency of a site's prices, or
+// types.DefaultCurrency when the site has not set one
+func GetSiteCurrency(ctx context.Context, session neo4j.SessionWithContext, siteID string) (string, error) {
+	query := `MATCH (s:Site {id: $id}) RETURN s.currency AS currency`
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"id": siteID})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return "", err
+	}
+	for _, record := range result.([]*neo4j.Record) {
+		if currency, _ := record.Get("currency"); currency != nil {
+			return types.ParseCurrency(currency.(string))
+		}
+	}
+	return types.DefaultCurrency, nil
+}
+
+// FormatPrices replaces the minor unit prices of a result row with
+// types.Money in the row's "currency", which is removed. Maps nested under
+// keys, such as a best variation, are formatted the same way
+func FormatPrices(row map[string]any, keys ...string) {
+	currency, _ := row["currency"].(string)
+	if currency == "" {
+		currency = types.DefaultCurrency
+	}
+	delete(row, "currency")
+	for _, key := range priceKeys {
+		if minor, ok := row[key].(int64); ok {
+			row[key] = types.Money{Minor: minor, Currency: currency}
+		}
+	}
+	for _, key := range keys {
+		if nested, ok := row[key].(map[string]any); ok {
+			FormatPrices(nested)
+		}
+	}
+}
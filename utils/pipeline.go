@@ -0,0 +1,419 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+const (
+	defaultEmbedConcurrency = 4
+	defaultWriteBatchSize   = 100
+	// writeFlushInterval is how long a partial batch waits for more products
+	writeFlushInterval = 500 * time.Millisecond
+)
+
+// ProductUpsert is one WooCommerce product moving through the ingestion pipeline
+type ProductUpsert struct {
+	Product    types.WooCommerceProduct
+	ID         string
+	Outcome    string
+	Text       string
+	Reembed    bool
+	Properties map[string]any
+	// Chunks replace the product's ProductChunk nodes when not nil
+	Chunks []map[string]any
+	// Variations replace the product's Variation nodes when not nil
+	Variations []map[string]any
+	// Version is the ProductVersion written with a created or updated product
+	Version map[string]any
+	Err     error
+}
+
+// ProductStore reads and writes the products of a site for the ingestion pipeline
+type ProductStore interface {
+	// Existing returns the stored id and properties of the site's products
+	// with the given WooCommerce ids
+	Existing(ctx context.Context, siteID string, externalIDs []int, keys []string) (map[int]map[string]any, error)
+	// Write upserts products in a single transaction
+	Write(ctx context.Context, siteID string, upserts []*ProductUpsert) error
+}
+
+// IngestPipeline upserts pages of products, embedding changed products with
+// Concurrency workers and writing them in UNWIND batches of BatchSize. The
+// stages are joined by bounded queues, so a slow embedder or database holds
+// back the stages feeding it instead of buffering the catalog in memory
+type IngestPipeline struct {
+	Store       ProductStore
+	Targets     []TargetEmbedder
+	Concurrency int
+	BatchSize   int
+	Report      ProductReporter
+	// Currency of the site's prices, types.DefaultCurrency when empty
+	Currency string
+	// Source recorded on product versions, ProductSourceSync when empty
+	Source string
+}
+
+// NewIngestPipeline returns a pipeline writing to Neo4j and embedding for the
+// current write targets, with INGEST_EMBED_CONCURRENCY (default 4) embedding
+// workers and INGEST_WRITE_BATCH_SIZE (default 100) products per write
+func NewIngestPipeline(ctx context.Context, session neo4j.SessionWithContext) (*IngestPipeline, error) {
+	targets, err := embeddingWriteTargets(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	concurrency := defaultEmbedConcurrency
+	if value, err := strconv.Atoi(os.Getenv("INGEST_EMBED_CONCURRENCY")); err == nil && value > 0 {
+		concurrency = value
+	}
+	batchSize := defaultWriteBatchSize
+	if value, err := strconv.Atoi(os.Getenv("INGEST_WRITE_BATCH_SIZE")); err == nil && value > 0 {
+		batchSize = value
+	}
+	return &IngestPipeline{
+		Store:       &neo4jProductStore{session: session},
+		Targets:     targets,
+		Concurrency: concurrency,
+		BatchSize:   batchSize,
+		Source:      ProductSourceSync,
+	}, nil
+}
+
+// Run upserts every page of products that source passes to add and returns
+// the counts of their outcomes. An error from source or from reading existing
+// products stops the run; a product failing to embed or write is only counted
+func (ip *IngestPipeline) Run(ctx context.Context, siteID string, source func(add func(products []types.WooCommerceProduct) error) error) (UpsertCounts, error) {
+	var counts UpsertCounts
+	var mu sync.Mutex
+	report := func(upsert *ProductUpsert) {
+		mu.Lock()
+		defer mu.Unlock()
+		if upsert.Err != nil {
+			log.Printf("Error storing product %d: %s", upsert.Product.ID, upsert.Err.Error())
+			counts.Failed++
+		} else {
+			counts.Add(upsert.Outcome)
+		}
+		if ip.Report != nil {
+			ip.Report(upsert.Product.ID, upsert.Outcome, upsert.Err)
+		}
+	}
+
+	concurrency := max(ip.Concurrency, 1)
+	batchSize := max(ip.BatchSize, 1)
+	embedQueue := make(chan *ProductUpsert, concurrency*2)
+	writeQueue := make(chan *ProductUpsert, batchSize)
+
+	var embedders sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		embedders.Add(1)
+		go func() {
+			defer embedders.Done()
+			for upsert := range embedQueue {
+				if upsert.Reembed {
+					if err := ip.embed(upsert); err != nil {
+						upsert.Err = err
+						report(upsert)
+						continue
+					}
+				}
+				writeQueue <- upsert
+			}
+		}()
+	}
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		ip.writeBatches(ctx, siteID, writeQueue, batchSize, report)
+	}()
+
+	err := source(func(products []types.WooCommerceProduct) error {
+		upserts, err := ip.plan(ctx, siteID, products)
+		if err != nil {
+			return err
+		}
+		for _, upsert := range upserts {
+			if upsert.Err != nil || upsert.Outcome == ProductUnchanged {
+				report(upsert)
+				continue
+			}
+			select {
+			case embedQueue <- upsert:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	close(embedQueue)
+	embedders.Wait()
+	close(writeQueue)
+	<-writerDone
+	return counts, err
+}
+
+// plan prepares the text of each product and compares it with the stored
+// product to decide whether it is created, updated, unchanged or re-embedded.
+// Products whose prices do not parse are returned with Err set
+func (ip *IngestPipeline) plan(ctx context.Context, siteID string, products []types.WooCommerceProduct) ([]*ProductUpsert, error) {
+	currency := ip.Currency
+	if currency == "" {
+		currency = types.DefaultCurrency
+	}
+	source := ip.Source
+	if source == "" {
+		source = ProductSourceSync
+	}
+	upserts := make([]*ProductUpsert, len(products))
+	externalIDs := make([]int, len(products))
+	for i, product := range products {
+		upserts[i] = newProductUpsert(product, currency)
+		externalIDs[i] = product.ID
+	}
+	if len(upserts) == 0 {
+		return upserts, nil
+	}
+	// Products may differ in their keys, variations_hash only being set on
+	// products whose variations were fetched
+	var keys []string
+	seen := map[string]bool{}
+	for _, upsert := range upserts {
+		for key := range upsert.Properties {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	existing, err := ip.Store.Existing(ctx, siteID, externalIDs, keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, upsert := range upserts {
+		if upsert.Err != nil {
+			continue
+		}
+		stored, found := existing[upsert.Product.ID]
+		if !found {
+			upsert.ID, upsert.Outcome, upsert.Reembed = NewID(), ProductCreated, true
+			upsert.Version = productVersion(source, nil, upsert.Properties)
+			continue
+		}
+		upsert.ID, upsert.Outcome = fmt.Sprint(stored["id"]), ProductUnchanged
+		if upsert.Version = productVersion(source, stored, upsert.Properties); upsert.Version != nil {
+			upsert.Outcome = ProductUpdated
+		}
+		upsert.Reembed = stored["content_hash"] != upsert.Properties["content_hash"]
+	}
+	return upserts, nil
+}
+
+// embed adds the product and chunk vectors of every target to upsert
+func (ip *IngestPipeline) embed(upsert *ProductUpsert) error {
+	embeddings, err := productEmbeddings(ip.Targets, upsert.Text)
+	if err != nil {
+		return err
+	}
+	for key, value := range embeddings {
+		upsert.Properties[key] = value
+	}
+	upsert.Chunks, err = embedChunks(ip.Targets, upsert.Text)
+	return err
+}
+
+// writeBatches writes queued products batchSize at a time, flushing a partial
+// batch once no product has arrived for writeFlushInterval. A failed batch is
+// retried one product at a time so one bad product does not fail the others
+func (ip *IngestPipeline) writeBatches(ctx context.Context, siteID string, queue <-chan *ProductUpsert, batchSize int, report func(*ProductUpsert)) {
+	var batch []*ProductUpsert
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := ip.Store.Write(ctx, siteID, batch); err != nil {
+			for _, upsert := range batch {
+				if len(batch) == 1 {
+					upsert.Err = err
+				} else {
+					upsert.Err = ip.Store.Write(ctx, siteID, []*ProductUpsert{upsert})
+				}
+			}
+		}
+		for _, upsert := range batch {
+			report(upsert)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case upsert, ok := <-queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, upsert)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-time.After(writeFlushInterval):
+			flush()
+		}
+	}
+}
+
+// neo4jProductStore serialises its use of the session, which is not safe for
+// the pipeline's concurrent planning and writing
+type neo4jProductStore struct {
+	mu      sync.Mutex
+	session neo4j.SessionWithContext
+}
+
+func (ns *neo4jProductStore) Existing(ctx context.Context, siteID string, externalIDs []int, keys []string) (map[int]map[string]any, error) {
+	// Only the compared properties are read back, not the stored vectors
+	query := `
+    UNWIND $external_ids AS external_id
+    MATCH (p:Product {site_id: $site_id, external_id: external_id})
+    RETURN external_id, p.id AS id, [key IN $keys | p[key]] AS values
+    `
+	params := map[string]any{"site_id": siteID, "external_ids": externalIDs, "keys": keys}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	result, err := ns.session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	existing := map[int]map[string]any{}
+	for _, record := range result.([]*neo4j.Record) {
+		externalID, _ := record.Get("external_id")
+		id, _ := record.Get("id")
+		values, _ := record.Get("values")
+		stored := map[string]any{"id": id}
+		for i, value := range values.([]any) {
+			stored[keys[i]] = value
+		}
+		existing[int(externalID.(int64))] = stored
+	}
+	return existing, nil
+}
+
+func (ns *neo4jProductStore) Write(ctx context.Context, siteID string, upserts []*ProductUpsert) error {
+	query := `
+    MATCH (s:Site {id: $site_id})
+    UNWIND $products AS product
+    MERGE (p:Product {site_id: $site_id, external_id: product.external_id})
+    ON CREATE SET p.id = product.id, p.created_at = datetime()
+    SET p += product.properties, p.updated_at = datetime()
+    MERGE (p)-[:BELONGS_TO]->(s)
+    WITH p, product, product.version AS version` + productVersionCypher + `
+    WITH p, product
+    CALL {
+        WITH p
+        OPTIONAL MATCH (p)-[old:IN_CATEGORY|TAGGED|HAS_ATTRIBUTE]->()
+        DELETE old
+    }
+    CALL {
+        WITH p, product
+        UNWIND product.categories AS category
+        MERGE (c:Category {site_id: p.site_id, external_id: category.id})
+        SET c.name = category.name, c.slug = category.slug
+        MERGE (p)-[:IN_CATEGORY]->(c)
+    }
+    CALL {
+        WITH p, product
+        UNWIND product.tags AS tag
+        MERGE (t:Tag {site_id: p.site_id, external_id: tag.id})
+        SET t.name = tag.name, t.slug = tag.slug
+        MERGE (p)-[:TAGGED]->(t)
+    }
+    CALL {
+        WITH p, product
+        UNWIND product.attributes AS attribute
+        MERGE (a:Attribute {site_id: p.site_id, name: attribute.name})
+        SET a.external_id = attribute.id
+        MERGE (p)-[r:HAS_ATTRIBUTE]->(a)
+        SET r.options = attribute.options, r.variation = attribute.variation
+    }
+    CALL {
+        WITH p, product
+        OPTIONAL MATCH (p)-[:HAS_VARIATION]->(old:Variation)
+        WHERE product.variations IS NOT NULL
+              AND NOT old.external_id IN [variation IN product.variations | variation.id]
+        DETACH DELETE old
+    }
+    CALL {
+        WITH p, product
+        UNWIND coalesce(product.variations, []) AS variation
+        MERGE (v:Variation {site_id: p.site_id, external_id: variation.id})
+        ON CREATE SET v.id = variation.new_id, v.created_at = datetime()
+        SET v += variation.properties, v.updated_at = datetime()
+        MERGE (p)-[:HAS_VARIATION]->(v)
+        WITH v, variation
+        OPTIONAL MATCH (v)-[old:HAS_ATTRIBUTE]->()
+        DELETE old
+        WITH DISTINCT v, variation
+        UNWIND variation.attributes AS attribute
+        MERGE (a:Attribute {site_id: v.site_id, name: attribute.name})
+        MERGE (v)-[r:HAS_ATTRIBUTE]->(a)
+        SET r.option = attribute.option
+    }
+    WITH p, product WHERE product.chunks IS NOT NULL
+    // Re-embedded products get their chunks replaced
+    OPTIONAL MATCH (p)-[:HAS_CHUNK]->(old:ProductChunk)
+    DETACH DELETE old
+    WITH DISTINCT p, product
+    UNWIND product.chunks AS chunk
+    CREATE (p)-[:HAS_CHUNK]->(c:ProductChunk {index: chunk.index, text: chunk.text})
+    SET c += chunk.embeddings
+    `
+	products := make([]map[string]any, len(upserts))
+	for i, upsert := range upserts {
+		products[i] = map[string]any{
+			"id":          upsert.ID,
+			"external_id": upsert.Product.ID,
+			"properties":  upsert.Properties,
+			"chunks":      nil,
+			"variations":  nil,
+			"version":     upsert.Version,
+		}
+		for key, value := range wooCommerceProductTerms(upsert.Product) {
+			products[i][key] = value
+		}
+		// Variations left nil keep the stored ones
+		if upsert.Variations != nil {
+			for _, variation := range upsert.Variations {
+				variation["new_id"] = NewID()
+			}
+			products[i]["variations"] = upsert.Variations
+		}
+		if upsert.Chunks != nil {
+			products[i]["chunks"] = upsert.Chunks
+		}
+	}
+	params := map[string]any{"site_id": siteID, "products": products}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	_, err := ns.session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return err
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// similarCandidates is how many nearest products are fetched per requested
+// one, leaving room for those dropped by the site scope and filters
+const similarCandidates = 10
+
+// GetProductDetail returns an active product with its categories, tags,
+// attributes, variations, allergens, gender and affiliations
+func GetProductDetail(ctx context.Context, session neo4j.SessionWithContext, id string) (map[string]any, bool, error) {
+	query := `
+    MATCH (p:Product {id: $id})
+    WHERE coalesce(p.active, true)
+    RETURN p {.id, .name, .slug, .type, .sku, .description, .short_description, .permalink,
+              .featured_image, .images, .price, .regular_price, .sale_price, .currency,
+              .stock_status, .on_sale, .site_id, .external_id, .version,
+              created_at: toString(p.created_at), updated_at: toString(p.updated_at),
+              categories: [(p)-[:IN_CATEGORY]->(c:Category) | c {.name, .slug}],
+              tags: [(p)-[:TAGGED]->(t:Tag) | t {.name, .slug}],
+              attributes: [(p)-[r:HAS_ATTRIBUTE]->(a:Attribute) | {name: a.name, options: r.options}],
+              variations: [(p)-[:HAS_VARIATION]->(v:Variation) |
+                           v {.id, .sku, .price, .regular_price, .sale_price, .currency, .on_sale,
+                              .stock_status, .stock_quantity, .permalink, .image,
+                              attributes: [(v)-[r:HAS_ATTRIBUTE]->(a:Attribute) | {name: a.name, option: r.option}]}],
+              allergens: [(p)-[:HAS_ALLERGY]->(a:Allergens) | a.type],
+              gender: head([(p)-[:GENDER]->(g:Gender) | g.type]),
+              affiliations: [(p)-[:IS_AFFILIATED_WITH]->(af:Affiliations) | af {.id, .name}]} AS product
+    `
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"id": id})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, false, err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return nil, false, nil
+	}
+	value, _ := records[0].Get("product")
+	product := value.(map[string]any)
+	FormatPrices(product)
+	if variations, ok := product["variations"].([]any); ok {
+		for _, variation := range variations {
+			FormatPrices(variation.(map[string]any))
+		}
+	}
+	return product, true, nil
+}
+
+// ParseAttributeFilter checks a "name:option" attribute filter
+func ParseAttributeFilter(filter string) (map[string]any, error) {
+	name, option, ok := strings.Cut(filter, ":")
+	if name, option = strings.TrimSpace(name), strings.TrimSpace(option); !ok || name == "" || option == "" {
+		return nil, fmt.Errorf("attribute %q must be name:option", filter)
+	}
+	return map[string]any{"name": name, "option": option}, nil
+}
+
+// GetSimilarProducts returns the active products of the same site as the
+// product id, nearest to its stored embedding in the active target's index.
+// found is false when id is not an active product; a product without an
+// embedding has no similar products
+func GetSimilarProducts(ctx context.Context, session neo4j.SessionWithContext, id string, query types.SimilarProductsQuery) ([]map[string]any, bool, error) {
+	target, _, err := GetEmbeddingTargets(ctx, session)
+	if err != nil {
+		return nil, false, err
+	}
+	attributes := []map[string]any{}
+	for _, filter := range query.Attributes {
+		attribute, err := ParseAttributeFilter(filter)
+		if err != nil {
+			return nil, false, err
+		}
+		attributes = append(attributes, attribute)
+	}
+	cypher := fmt.Sprintf(`
+    MATCH (source:Product {id: $id})
+    WHERE coalesce(source.active, true)
+    CALL {
+        WITH source
+        WITH source, source[$property] AS vector
+        WHERE vector IS NOT NULL
+        CALL db.index.vector.queryNodes('%s', $limit * %d + 1, vector)
+        YIELD node AS product, score
+        WITH product, score
+        WHERE product <> source AND coalesce(product.active, true)
+              AND coalesce(product.site_id, "") = coalesce(source.site_id, "")
+              AND (size($categories) = 0 OR EXISTS { (product)-[:IN_CATEGORY]->(c:Category) WHERE c.slug IN $categories })
+              AND (size($tags) = 0 OR EXISTS { (product)-[:TAGGED]->(t:Tag) WHERE t.slug IN $tags })
+              AND all(filter IN $attributes WHERE EXISTS {
+                  (product)-[r:HAS_ATTRIBUTE]->(a:Attribute)
+                  WHERE toLower(a.name) = toLower(filter.name)
+                        AND any(option IN r.options WHERE toLower(option) = toLower(filter.option))
+              })
+              AND (NOT $in_stock OR product.stock_status = "instock")
+              AND (NOT $on_sale OR product.on_sale)
+              AND ($min_price IS NULL OR (product.currency = $min_currency AND product.price >= $min_price))
+              AND ($max_price IS NULL OR (product.currency = $max_currency AND product.price <= $max_price))
+        WITH product, score
+        ORDER BY score DESC LIMIT $limit
+        RETURN collect(product {.id, .name, .price, .regular_price, .sale_price, .currency, .permalink,
+                                .featured_image, .stock_status, .on_sale,
+                                categories: [(product)-[:IN_CATEGORY]->(c:Category) | c.slug],
+                                score: score}) AS similar
+    }
+    RETURN similar
+    `, target.Index, similarCandidates)
+	params := map[string]any{
+		"id":           id,
+		"property":     target.Property,
+		"limit":        query.Limit,
+		"categories":   append([]string{}, query.Categories...),
+		"tags":         append([]string{}, query.Tags...),
+		"attributes":   attributes,
+		"in_stock":     query.InStock,
+		"on_sale":      query.OnSale,
+		"min_price":    nil,
+		"min_currency": nil,
+		"max_price":    nil,
+		"max_currency": nil,
+	}
+	if query.MinPrice != nil {
+		params["min_price"], params["min_currency"] = query.MinPrice.Minor, query.MinPrice.Currency
+	}
+	if query.MaxPrice != nil {
+		params["max_price"], params["max_currency"] = query.MaxPrice.Minor, query.MaxPrice.Currency
+	}
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, cypher, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, false, err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return nil, false, nil
+	}
+	value, _ := records[0].Get("similar")
+	similar := []map[string]any{}
+	for _, product := range value.([]any) {
+		product := product.(map[string]any)
+		FormatPrices(product)
+		similar = append(similar, product)
+	}
+	return similar, true, nil
+}
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// DefaultProductSort lists the newest products first, as the listing always has
+const DefaultProductSort = "-id"
+
+// productSortKeys are the Cypher expressions products can be sorted by. Keys
+// are never null so that a cursor can resume after any product
+var productSortKeys = map[string]string{
+	"id":         "p.id",
+	"price":      "coalesce(p.price, -1)",
+	"name":       "toLower(coalesce(p.name, ''))",
+	"updated_at": "coalesce(p.updated_at, p.created_at, datetime({epochMillis: 0})).epochMillis",
+}
+
+// productFilterCypher matches the active products of a ProductListQuery
+const productFilterCypher = `
+    MATCH (p:Product)
+    WHERE coalesce(p.active, true)
+          AND ($site_id IS NULL OR p.site_id = $site_id)
+          AND (size($categories) = 0 OR EXISTS { (p)-[:IN_CATEGORY]->(c:Category) WHERE c.slug IN $categories })
+          AND ($min_price IS NULL OR (p.currency = $min_currency AND p.price >= $min_price))
+          AND ($max_price IS NULL OR (p.currency = $max_currency AND p.price <= $max_price))
+          AND NOT EXISTS { (p)-[:HAS_ALLERGY]->(a:Allergens) WHERE a.key IN $allergen_free }
+          AND ($gender IS NULL OR EXISTS { (p)-[:GENDER]->(:Gender {type: $gender}) })
+          AND ($stock_status IS NULL OR p.stock_status = $stock_status)
+          AND ($affiliation IS NULL OR EXISTS { (p)-[:IS_AFFILIATED_WITH]->(:Affiliations {id: $affiliation}) })
+    `
+
+// ProductPage is a page of the product listing. NextCursor is empty on the
+// last page
+type ProductPage struct {
+	Products   []map[string]any `json:"products"`
+	Total      int64            `json:"total"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// productCursor is the position of the last product of a page
+type productCursor struct {
+	Sort  string `json:"sort"`
+	Value any    `json:"value"`
+	ID    string `json:"id"`
+}
+
+// ValidateProductListQuery defaults the sort of query and checks that its
+// sort is supported and its cursor was issued for that sort
+func ValidateProductListQuery(query *types.ProductListQuery) error {
+	if query.Sort == "" {
+		query.Sort = DefaultProductSort
+	}
+	if _, ok := productSortKeys[strings.TrimPrefix(query.Sort, "-")]; !ok {
+		return fmt.Errorf("sort must be one of id, price, name or updated_at, prefixed with - to sort descending")
+	}
+	if query.Cursor != "" {
+		if _, err := decodeProductCursor(query.Cursor, query.Sort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeProductCursor(cursor productCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeProductCursor(value string, sort string) (*productCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var cursor productCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID == "" {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	if cursor.Sort != sort {
+		return nil, fmt.Errorf("cursor was issued for sort %q", cursor.Sort)
+	}
+	// JSON numbers decode as floats, sort keys that are numbers are integers
+	if number, ok := cursor.Value.(float64); ok && number == math.Trunc(number) {
+		cursor.Value = int64(number)
+	}
+	return &cursor, nil
+}
+
+// ListProducts returns a page of the active products matching a query
+// checked by ValidateProductListQuery, after query.Cursor, with the number of
+// matching products
+func ListProducts(ctx context.Context, session neo4j.SessionWithContext, query types.ProductListQuery) (*ProductPage, error) {
+	if err := ValidateProductListQuery(&query); err != nil {
+		return nil, err
+	}
+	sort := query.Sort
+	key := productSortKeys[strings.TrimPrefix(sort, "-")]
+	direction, after := "ASC", ">"
+	if strings.HasPrefix(sort, "-") {
+		direction, after = "DESC", "<"
+	}
+	params := map[string]any{
+		"limit":         query.Limit + 1,
+		"site_id":       nil,
+		"categories":    append([]string{}, query.Categories...),
+		"min_price":     nil,
+		"min_currency":  nil,
+		"max_price":     nil,
+		"max_currency":  nil,
+		"allergen_free": []string{},
+		"gender":        nil,
+		"stock_status":  nil,
+		"affiliation":   nil,
+		"cursor":        nil,
+	}
+	if query.SiteID != "" {
+		params["site_id"] = query.SiteID
+	}
+	if query.MinPrice != nil {
+		params["min_price"], params["min_currency"] = query.MinPrice.Minor, query.MinPrice.Currency
+	}
+	if query.MaxPrice != nil {
+		params["max_price"], params["max_currency"] = query.MaxPrice.Minor, query.MaxPrice.Currency
+	}
+	// Excluded allergens match through the synonyms of their canonical Allergens node
+	allergens, err := ResolveAllergens(ctx, session, query.AllergenFree)
+	if err != nil {
+		return nil, err
+	}
+	for _, allergen := range allergens {
+		params["allergen_free"] = append(params["allergen_free"].([]string), allergen["key"].(string))
+	}
+	if query.Gender != "" {
+		params["gender"] = query.Gender
+	}
+	if query.StockStatus != "" {
+		params["stock_status"] = query.StockStatus
+	}
+	if query.Affiliation != nil {
+		params["affiliation"] = *query.Affiliation
+	}
+	if query.Cursor != "" {
+		cursor, err := decodeProductCursor(query.Cursor, sort)
+		if err != nil {
+			return nil, err
+		}
+		params["cursor"] = map[string]any{"value": cursor.Value, "id": cursor.ID}
+	}
+
+	countQuery := productFilterCypher + `RETURN count(p) AS total`
+	pageQuery := productFilterCypher + fmt.Sprintf(`
+    WITH p, %[1]s AS sort_key
+    WHERE $cursor IS NULL OR sort_key %[2]s $cursor.value OR (sort_key = $cursor.value AND p.id %[2]s $cursor.id)
+    RETURN p {.id, .name, .description, .price, .currency, .site_id, .stock_status,
+              updated_at: toString(p.updated_at),
+              allergens: [(p)-[:HAS_ALLERGY]->(a:Allergens) | a.type],
+              gender: head([(p)-[:GENDER]->(g:Gender) | g.type]),
+              affiliation_ids: [(p)-[:IS_AFFILIATED_WITH]->(af:Affiliations) | af.id]} AS product,
+           sort_key
+    ORDER BY sort_key %[3]s, p.id %[3]s
+    LIMIT $limit
+    `, key, after, direction)
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, countQuery, params)
+			if err != nil {
+				return nil, err
+			}
+			count, err := result.Single(ctx)
+			if err != nil {
+				return nil, err
+			}
+			result, err = tx.Run(ctx, pageQuery, params)
+			if err != nil {
+				return nil, err
+			}
+			records, err := result.Collect(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return append([]*neo4j.Record{count}, records...), nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	records := result.([]*neo4j.Record)
+	total, _ := records[0].Get("total")
+	page := &ProductPage{Products: []map[string]any{}, Total: total.(int64)}
+	records = records[1:]
+	if len(records) > query.Limit {
+		last := records[query.Limit-1]
+		product, _ := last.Get("product")
+		value, _ := last.Get("sort_key")
+		page.NextCursor = encodeProductCursor(productCursor{Sort: sort, Value: value, ID: product.(map[string]any)["id"].(string)})
+		records = records[:query.Limit]
+	}
+	for _, record := range records {
+		value, _ := record.Get("product")
+		product := value.(map[string]any)
+		FormatPrices(product)
+		page.Products = append(page.Products, product)
+	}
+	return page, nil
+}
@@ -0,0 +1,273 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// Upsert outcomes reported by UpsertWooCommerceProduct
+const (
+	ProductCreated   = "created"
+	ProductUpdated   = "updated"
+	ProductUnchanged = "unchanged"
+)
+
+// UpsertCounts tallies the outcomes of a batch of product upserts
+type UpsertCounts struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+}
+
+// Add counts one upsert outcome
+func (uc *UpsertCounts) Add(outcome string) {
+	switch outcome {
+	case ProductCreated:
+		uc.Created++
+	case ProductUpdated:
+		uc.Updated++
+	case ProductUnchanged:
+		uc.Unchanged++
+	}
+}
+
+// ContentHash returns the sha256 of the prepared text of a product, used to
+// skip re-embedding products whose text has not changed
+func ContentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetSiteIDBySecret returns the id of the Site owning the API secret pair
+func GetSiteIDBySecret(ctx context.Context, session neo4j.SessionWithContext, secretID string, secret string) (string, error) {
+	query := `MATCH (s:Site {secretID: $secretID, secret: $secret}) RETURN s.id AS id`
+	params := map[string]any{"secretID": secretID, "secret": secret}
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return "", err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return "", fmt.Errorf("site not found")
+	}
+	id, _ := records[0].Get("id")
+	return fmt.Sprint(id), nil
+}
+
+// GetSiteIDBySecretID returns the id of the Site an API token was issued for
+func GetSiteIDBySecretID(ctx context.Context, session neo4j.SessionWithContext, secretID string) (string, error) {
+	query := `MATCH (s:Site {secretID: $secretID}) RETURN s.id AS id`
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"secretID": secretID})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return "", err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return "", fmt.Errorf("site not found")
+	}
+	id, _ := records[0].Get("id")
+	return fmt.Sprint(id), nil
+}
+
+// newProductUpsert prepares the text, properties and variations of a product
+// with its prices in currency, setting Err when a price does not parse
+func newProductUpsert(product types.WooCommerceProduct, currency string) *ProductUpsert {
+	text := PrepareProductText(product)
+	upsert := &ProductUpsert{Product: product, Text: text}
+	upsert.Variations, upsert.Err = wooCommerceProductVariations(product, currency)
+	if upsert.Err == nil {
+		upsert.Properties, upsert.Err = wooCommerceProductProperties(product, ContentHash(text), currency, upsert.Variations)
+	}
+	return upsert
+}
+
+// wooCommercePrices parses the price fields WooCommerce sends as decimal
+// strings into the minor units stored on Product and Variation nodes
+func wooCommercePrices(currency string, price string, regularPrice string, salePrice string) (map[string]any, error) {
+	prices := map[string]any{"currency": currency}
+	for key, amount := range map[string]string{"price": price, "regular_price": regularPrice, "sale_price": salePrice} {
+		money, err := types.ParseMoney(amount, currency)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		prices[key] = nil
+		if money != nil {
+			prices[key] = money.Minor
+		}
+	}
+	return prices, nil
+}
+
+// wooCommerceProductProperties returns the Product node properties stored for
+// a WooCommerce product, excluding embeddings. terms_hash changes with the
+// product's categories, tags and attributes so relationship changes are
+// written even when no other property changed
+func wooCommerceProductProperties(product types.WooCommerceProduct, contentHash string, currency string, variations []map[string]any) (map[string]any, error) {
+	images := []string{}
+	for _, image := range product.Images {
+		images = append(images, image.Src)
+	}
+	featuredImage := product.FeaturedImage
+	if featuredImage == "" && len(images) > 0 {
+		featuredImage = images[0]
+	}
+	terms, _ := json.Marshal(wooCommerceProductTerms(product))
+	properties, err := wooCommercePrices(currency, product.Price, product.RegularPrice, product.SalePrice)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range map[string]any{
+		"name":              product.Name,
+		"slug":              product.Slug,
+		"type":              product.Type,
+		"sku":               product.SKU,
+		"description":       product.Description,
+		"short_description": product.ShortDescription,
+		"permalink":         product.Permalink,
+		"featured_image":    featuredImage,
+		"images":            images,
+		"stock_status":      product.StockStatus,
+		"on_sale":           product.OnSale,
+		"content_hash":      contentHash,
+		"terms_hash":        ContentHash(string(terms)),
+	} {
+		properties[key] = value
+	}
+	// Variations are only compared when they were fetched
+	if variations != nil {
+		encoded, _ := json.Marshal(variations)
+		properties["variations_hash"] = ContentHash(string(encoded))
+	}
+	return properties, nil
+}
+
+// wooCommerceProductVariations returns the variations of a variable product as
+// the parameters of the query writing its Variation nodes, or nil when they
+// were not fetched
+func wooCommerceProductVariations(product types.WooCommerceProduct, currency string) ([]map[string]any, error) {
+	if product.Variations == nil {
+		return nil, nil
+	}
+	variations := []map[string]any{}
+	for _, variation := range product.Variations {
+		image := ""
+		if variation.Image != nil {
+			image = variation.Image.Src
+		}
+		var stockQuantity any
+		if variation.StockQuantity != nil {
+			stockQuantity = *variation.StockQuantity
+		}
+		attributes := []map[string]any{}
+		for _, attribute := range variation.Attributes {
+			attributes = append(attributes, map[string]any{"name": attribute.Name, "option": attribute.Option})
+		}
+		properties, err := wooCommercePrices(currency, variation.Price, variation.RegularPrice, variation.SalePrice)
+		if err != nil {
+			return nil, fmt.Errorf("variation %d: %v", variation.ID, err)
+		}
+		for key, value := range map[string]any{
+			"sku":            variation.SKU,
+			"on_sale":        variation.OnSale,
+			"stock_status":   variation.StockStatus,
+			"stock_quantity": stockQuantity,
+			"permalink":      variation.Permalink,
+			"image":          image,
+		} {
+			properties[key] = value
+		}
+		variations = append(variations, map[string]any{
+			"id":         variation.ID,
+			"properties": properties,
+			"attributes": attributes,
+		})
+	}
+	return variations, nil
+}
+
+// wooCommerceProductTerms returns the categories, tags and attributes of a
+// product as the parameters of the queries linking it to Category, Tag and
+// Attribute nodes
+func wooCommerceProductTerms(product types.WooCommerceProduct) map[string]any {
+	term := func(terms []types.WooCommerceTerm) []map[string]any {
+		params := []map[string]any{}
+		for _, term := range terms {
+			params = append(params, map[string]any{"id": term.ID, "name": term.Name, "slug": term.Slug})
+		}
+		return params
+	}
+	attributes := []map[string]any{}
+	for _, attribute := range product.Attributes {
+		options := attribute.Options
+		if options == nil {
+			options = []string{}
+		}
+		attributes = append(attributes, map[string]any{
+			"id":        attribute.ID,
+			"name":      attribute.Name,
+			"options":   options,
+			"variation": attribute.Variation,
+		})
+	}
+	return map[string]any{
+		"categories": term(product.Categories),
+		"tags":       term(product.Tags),
+		"attributes": attributes,
+	}
+}
+
+// UpsertWooCommerceProduct MERGEs a WooCommerce product of a site on its
+// (site_id, external_id) key, recording the change as a ProductVersion from
+// source. The product is only re-embedded when its prepared text changed, and
+// nothing is written when no property changed
+func UpsertWooCommerceProduct(ctx context.Context, session neo4j.SessionWithContext, siteID string, product types.WooCommerceProduct, source string) (string, string, error) {
+	pipeline, err := NewIngestPipeline(ctx, session)
+	if err != nil {
+		return "", "", err
+	}
+	pipeline.Source = source
+	if pipeline.Currency, err = GetSiteCurrency(ctx, session, siteID); err != nil {
+		return "", "", err
+	}
+	upserts, err := pipeline.plan(ctx, siteID, []types.WooCommerceProduct{product})
+	if err != nil {
+		return "", "", err
+	}
+	upsert := upserts[0]
+	if upsert.Err != nil {
+		return "", "", upsert.Err
+	}
+	if upsert.Outcome == ProductUnchanged {
+		return upsert.ID, upsert.Outcome, nil
+	}
+	if upsert.Reembed {
+		if err := pipeline.embed(upsert); err != nil {
+			return "", "", err
+		}
+	}
+	if err := pipeline.Store.Write(ctx, siteID, upserts); err != nil {
+		return "", "", err
+	}
+	return upsert.ID, upsert.Outcome, nil
+}
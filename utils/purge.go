@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+const (
+	defaultProductRetention = 30 * 24 * time.Hour
+	productPurgeInterval    = time.Hour
+)
+
+// ProductRetention returns how long soft deleted products are kept, from
+// PRODUCT_RETENTION (default 720h). "0" keeps them forever
+func ProductRetention() time.Duration {
+	value := os.Getenv("PRODUCT_RETENTION")
+	if value == "" {
+		return defaultProductRetention
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		log.Printf("Invalid PRODUCT_RETENTION %q, using %s", value, defaultProductRetention)
+		return defaultProductRetention
+	}
+	return retention
+}
+
+// PurgeDeletedProducts hard deletes the products soft deleted more than
+// retention ago, with their chunks, variations and purchase history
+func PurgeDeletedProducts(ctx context.Context, session neo4j.SessionWithContext, retention time.Duration) (int, error) {
+	query := `
+    MATCH (p:Product)
+    WHERE p.active = false AND p.deleted_at < datetime() - duration({seconds: $retention_seconds})
+    OPTIONAL MATCH (p)-[:HAS_CHUNK|HAS_VARIATION]->(c:ProductChunk|Variation)
+    DETACH DELETE c
+    WITH collect(DISTINCT p) AS products
+    FOREACH (p IN products | DETACH DELETE p)
+    RETURN size(products) AS purged
+    `
+	params := map[string]any{"retention_seconds": int64(retention.Seconds())}
+	purged, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			record, err := result.Single(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return record.Values[0], nil
+		})
+	if err != nil {
+		return 0, err
+	}
+	return int(purged.(int64)), nil
+}
+
+// StartProductPurger purges soft deleted products past PRODUCT_RETENTION every
+// hour. It does nothing when PRODUCT_RETENTION is "0"
+func StartProductPurger(ctx context.Context) {
+	retention := ProductRetention()
+	if retention == 0 {
+		return
+	}
+	log.Printf("Purging products deleted more than %s ago", retention)
+	go func() {
+		ticker := time.NewTicker(productPurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				purgeDeletedProducts(ctx, retention)
+			}
+		}
+	}()
+}
+
+func purgeDeletedProducts(ctx context.Context, retention time.Duration) {
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		log.Printf("Product purge could not connect to Neo4j: %v", err)
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	purged, err := PurgeDeletedProducts(ctx, session, retention)
+	if err != nil {
+		log.Printf("Product purge failed: %v", err)
+		return
+	}
+	if purged > 0 {
+		log.Printf("Purged %d deleted products", purged)
+	}
+}
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// RecommendationCandidates is how many products are searched per requested
+// recommendation, leaving room for those the constraints exclude
+const RecommendationCandidates = 4
+
+// UserProfile is what recommendations need to know about a patient. Allergens
+// and Gender leave out the Not-Known and Unknown placeholders. AllergenKeys
+// are the keys of the Allergens, which products are matched by
+type UserProfile struct {
+	ID           any      `json:"id"`
+	Allergens    []string `json:"allergens"`
+	AllergenKeys []string `json:"-"`
+	Gender       string   `json:"gender"`
+}
+
+// RecommendationConstraints exclude the recommendations a patient must not
+// get. Empty fields don't constrain
+type RecommendationConstraints struct {
+	User          *UserProfile
+	SiteID        string
+	AffiliationID *int
+}
+
+// FilterReason is a constraint that excluded a product
+type FilterReason struct {
+	Filter string `json:"filter"`
+	Detail string `json:"detail"`
+}
+
+// FilteredProduct is a product excluded from recommendations and why
+type FilteredProduct struct {
+	ProductID   any            `json:"product_id"`
+	ProductName any            `json:"product_name"`
+	Reasons     []FilterReason `json:"reasons"`
+}
+
+// ResolveUser returns the profile of the User with an IC/passport number or
+// email, nil when neither matches
+func ResolveUser(ctx context.Context, session neo4j.SessionWithContext, icPassport string, email string) (*UserProfile, error) {
+	if icPassport == "" && email == "" {
+		return nil, nil
+	}
+	query := `
+    MATCH (u:User)
+    WHERE ($ic_passport <> "" AND u.ic_passport = $ic_passport) OR ($email <> "" AND u.email = $email)
+    RETURN u.id AS id,
+           COLLECT { MATCH (u)-[:HAS_ALLERGY]->(a:Allergens) WHERE a.key <> "not-known" RETURN DISTINCT a {.key, .type} } AS allergens,
+           head(COLLECT { MATCH (u)-[:GENDER]->(g:Gender) WHERE g.type <> "Unknown" RETURN g.type }) AS gender
+    // Prefer the IC/passport number, which identifies a patient
+    ORDER BY CASE WHEN u.ic_passport = $ic_passport THEN 0 ELSE 1 END
+    LIMIT 1
+    `
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"ic_passport": icPassport, "email": email})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return nil, nil
+	}
+	user := &UserProfile{Allergens: []string{}, AllergenKeys: []string{}}
+	user.ID, _ = records[0].Get("id")
+	allergens, _ := records[0].Get("allergens")
+	for _, value := range allergens.([]any) {
+		allergen := value.(map[string]any)
+		user.Allergens = append(user.Allergens, fmt.Sprint(allergen["type"]))
+		user.AllergenKeys = append(user.AllergenKeys, fmt.Sprint(allergen["key"]))
+	}
+	if gender, _ := records[0].Get("gender"); gender != nil {
+		user.Gender = fmt.Sprint(gender)
+	}
+	return user, nil
+}
+
+// Reasons returns why a recommendation row, holding the product's
+// "allergen_keys", "gender", "affiliations" and "site_id", is excluded
+func (rc RecommendationConstraints) Reasons(row map[string]any) []FilterReason {
+	reasons := []FilterReason{}
+	if rc.User != nil {
+		var shared []string
+		keys, _ := row["allergen_keys"].([]any)
+		for _, key := range keys {
+			for i, userKey := range rc.User.AllergenKeys {
+				if key == userKey {
+					shared = append(shared, rc.User.Allergens[i])
+				}
+			}
+		}
+		if len(shared) > 0 {
+			reasons = append(reasons, FilterReason{Filter: "allergen", Detail: "Contains " + strings.Join(shared, ", ")})
+		}
+		gender, _ := row["gender"].(string)
+		if rc.User.Gender != "" && gender != "" && gender != "Unisex" && !strings.EqualFold(gender, rc.User.Gender) {
+			reasons = append(reasons, FilterReason{Filter: "gender", Detail: fmt.Sprintf("For %s patients", gender)})
+		}
+	}
+	if siteID, _ := row["site_id"].(string); rc.SiteID != "" && siteID != rc.SiteID {
+		reasons = append(reasons, FilterReason{Filter: "site", Detail: "Sold by another site"})
+	}
+	// Products without affiliations are available to every affiliation
+	if affiliations, _ := row["affiliations"].([]any); rc.AffiliationID != nil && len(affiliations) > 0 {
+		affiliated := false
+		for _, id := range affiliations {
+			if id == int64(*rc.AffiliationID) {
+				affiliated = true
+			}
+		}
+		if !affiliated {
+			reasons = append(reasons, FilterReason{Filter: "affiliation", Detail: fmt.Sprintf("Not available to affiliation %d", *rc.AffiliationID)})
+		}
+	}
+	return reasons
+}
+
+// ApplyConstraints splits recommendation rows, ordered by score, into the
+// first limit allowed by rc and those it excluded. Rows name their product
+// with "product_id" and "product_name"; their "allergen_keys" are dropped
+func (rc RecommendationConstraints) ApplyConstraints(rows []map[string]any, limit int) ([]map[string]any, []FilteredProduct) {
+	allowed := []map[string]any{}
+	filtered := []FilteredProduct{}
+	for _, row := range rows {
+		reasons := rc.Reasons(row)
+		delete(row, "allergen_keys")
+		if len(reasons) > 0 {
+			filtered = append(filtered, FilteredProduct{ProductID: row["product_id"], ProductName: row["product_name"], Reasons: reasons})
+			continue
+		}
+		if len(allowed) < limit {
+			allowed = append(allowed, row)
+		}
+	}
+	return allowed, filtered
+}
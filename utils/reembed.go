@@ -0,0 +1,420 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+const (
+	defaultReembedBatchSize = 100
+	defaultReembedRate      = 10
+)
+
+// ReembedJob tracks a background re-embed of every product into a new
+// embedding target, persisted on a ReembedJob node so it can be resumed
+type ReembedJob struct {
+	ID        string          `json:"id"`
+	Target    EmbeddingTarget `json:"target"`
+	Status    string          `json:"status"`
+	Processed int             `json:"processed"`
+	Failed    int             `json:"failed"`
+	Total     int             `json:"total"`
+	Cursor    string          `json:"cursor"`
+	Error     string          `json:"error,omitempty"`
+}
+
+var (
+	runningReembedJobs   = map[string]bool{}
+	runningReembedJobsMu sync.Mutex
+)
+
+// StartReembedJob starts, or resumes from its stored cursor, the re-embed of
+// products into the target of the EMBEDDINGS_NEXT_ model
+func StartReembedJob() (ReembedJob, error) {
+	embedder, ok := GetNextEmbedder()
+	if !ok {
+		return ReembedJob{}, fmt.Errorf("EMBEDDINGS_NEXT_MODEL or EMBEDDINGS_NEXT_PROVIDER must be set to re-embed")
+	}
+	target := NewEmbeddingTarget(embedder.Model(), NextEmbeddingVersion())
+
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		return ReembedJob{}, err
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+
+	active, _, err := GetEmbeddingTargets(ctx, session)
+	if err != nil {
+		return ReembedJob{}, err
+	}
+	if active.Property == target.Property {
+		return ReembedJob{}, fmt.Errorf("model %s version %s is already active", target.Model, target.Version)
+	}
+
+	// Build the new indexes next to the active ones, sized from a probe vector
+	probe, err := EmbedWith(embedder, "product")
+	if err != nil {
+		return ReembedJob{}, err
+	}
+	if err := CreateVectorIndexes(ctx, session, target, len(probe)); err != nil {
+		return ReembedJob{}, err
+	}
+	if err := SetNextEmbeddingTarget(ctx, session, target); err != nil {
+		return ReembedJob{}, err
+	}
+
+	query := `
+    MERGE (j:ReembedJob {id: $id})
+    ON CREATE SET j.created_at = datetime()
+    // An interrupted job resumes from its cursor, a finished one starts over
+    // so products that failed are retried
+    WITH j, coalesce(j.status = "running", false) AS resuming
+    SET j.cursor = CASE WHEN resuming THEN j.cursor ELSE "" END,
+        j.processed = CASE WHEN resuming THEN j.processed ELSE 0 END,
+        j.failed = CASE WHEN resuming THEN j.failed ELSE 0 END
+    SET j.model = $model, j.version = $version, j.status = "running", j.error = null
+    RETURN j.cursor AS cursor, j.processed AS processed, j.failed AS failed
+    `
+	params := map[string]any{
+		"id":      target.Index,
+		"model":   target.Model,
+		"version": target.Version,
+	}
+	record, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Single(ctx)
+		})
+	if err != nil {
+		return ReembedJob{}, err
+	}
+	values := record.(*neo4j.Record).AsMap()
+	job := ReembedJob{
+		ID:        target.Index,
+		Target:    target,
+		Status:    "running",
+		Cursor:    values["cursor"].(string),
+		Processed: int(values["processed"].(int64)),
+		Failed:    int(values["failed"].(int64)),
+	}
+
+	runningReembedJobsMu.Lock()
+	defer runningReembedJobsMu.Unlock()
+	if !runningReembedJobs[job.ID] {
+		runningReembedJobs[job.ID] = true
+		// The job runs on its own copy so the one returned isn't written to
+		running := job
+		go running.run(embedder)
+	}
+	return job, nil
+}
+
+// ResumeReembedJobs restarts the re-embed job a restart interrupted, as long
+// as EMBEDDINGS_NEXT_ still names its model and version
+func ResumeReembedJobs(ctx context.Context) {
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		log.Printf("Could not resume re-embed jobs: %v", err)
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	query := `MATCH (j:ReembedJob {status: "running"}) RETURN j.id AS id`
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, nil)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		log.Printf("Could not resume re-embed jobs: %v", err)
+		return
+	}
+	embedder, ok := GetNextEmbedder()
+	for _, record := range result.([]*neo4j.Record) {
+		id, _ := record.Get("id")
+		if !ok || id != NewEmbeddingTarget(embedder.Model(), NextEmbeddingVersion()).Index {
+			log.Printf("Not resuming re-embed job %v, it is not for the EMBEDDINGS_NEXT_ model", id)
+			continue
+		}
+		if _, err := StartReembedJob(); err != nil {
+			log.Printf("Could not resume re-embed job %v: %v", id, err)
+		}
+	}
+}
+
+// GetReembedJob returns the stored progress of a re-embed job
+func GetReembedJob(id string) (ReembedJob, bool, error) {
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		return ReembedJob{}, false, err
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+	query := `MATCH (j:ReembedJob {id: $id}) RETURN j {.*} AS job`
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"id": id})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return ReembedJob{}, false, err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return ReembedJob{}, false, nil
+	}
+	value, _ := records[0].Get("job")
+	stored := value.(map[string]any)
+	model, _ := stored["model"].(string)
+	version, _ := stored["version"].(string)
+	job := ReembedJob{ID: id, Target: NewEmbeddingTarget(model, version)}
+	job.Status, _ = stored["status"].(string)
+	job.Cursor, _ = stored["cursor"].(string)
+	job.Error, _ = stored["error"].(string)
+	if processed, ok := stored["processed"].(int64); ok {
+		job.Processed = int(processed)
+	}
+	if failed, ok := stored["failed"].(int64); ok {
+		job.Failed = int(failed)
+	}
+	if total, ok := stored["total"].(int64); ok {
+		job.Total = int(total)
+	}
+	return job, true, nil
+}
+
+func (job *ReembedJob) run(embedder Embedder) {
+	defer func() {
+		runningReembedJobsMu.Lock()
+		delete(runningReembedJobs, job.ID)
+		runningReembedJobsMu.Unlock()
+	}()
+
+	ctx := context.Background()
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		log.Printf("Error connecting to Neo4j for re-embed job %s: %s", job.ID, err)
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+
+	if err := job.process(ctx, session, embedder); err != nil {
+		log.Printf("Re-embed job %s failed: %s", job.ID, err)
+		job.Status = "failed"
+		job.Error = err.Error()
+	} else {
+		job.Status = "completed"
+	}
+	if err := job.save(ctx, session); err != nil {
+		log.Printf("Error saving re-embed job %s: %s", job.ID, err)
+	}
+}
+
+func (job *ReembedJob) process(ctx context.Context, session neo4j.SessionWithContext, embedder Embedder) error {
+	batchSize := defaultReembedBatchSize
+	if value, err := strconv.Atoi(os.Getenv("REEMBED_BATCH_SIZE")); err == nil && value > 0 {
+		batchSize = value
+	}
+	rate := defaultReembedRate
+	if value, err := strconv.Atoi(os.Getenv("REEMBED_RATE_PER_SECOND")); err == nil && value > 0 {
+		rate = value
+	}
+	limiter := time.NewTicker(time.Second / time.Duration(rate))
+	defer limiter.Stop()
+
+	countQuery := fmt.Sprintf("MATCH (p:Product) WHERE elementId(p) > $cursor AND p.%s IS NULL RETURN count(p) AS remaining", job.Target.Property)
+	remaining, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, countQuery, map[string]any{"cursor": job.Cursor})
+			if err != nil {
+				return nil, err
+			}
+			record, err := result.Single(ctx)
+			if err != nil {
+				return nil, err
+			}
+			count, _ := record.Get("remaining")
+			return count, nil
+		})
+	if err != nil {
+		return err
+	}
+	job.Total = job.Processed + job.Failed + int(remaining.(int64))
+
+	batchQuery := fmt.Sprintf(`
+    MATCH (p:Product)
+    WHERE elementId(p) > $cursor AND p.%s IS NULL
+    RETURN elementId(p) AS element_id, p.id AS id, p.external_id AS external_id, p.name AS name,
+        p.description AS description, p.short_description AS short_description,
+        [(p)-[:IN_CATEGORY]->(c:Category) | c.name] AS categories,
+        [(p)-[:TAGGED]->(t:Tag) | t.name] AS tags,
+        [(p)-[r:HAS_ATTRIBUTE]->(a:Attribute) | {name: a.name, options: r.options}] AS attributes,
+        [(p)-[:HAS_CHUNK]->(c:ProductChunk) | {element_id: elementId(c), text: c.text}] AS chunks
+    ORDER BY element_id LIMIT $limit
+    `, job.Target.Property)
+	for {
+		result, err := session.ExecuteRead(ctx,
+			func(tx neo4j.ManagedTransaction) (any, error) {
+				result, err := tx.Run(ctx, batchQuery, map[string]any{"cursor": job.Cursor, "limit": batchSize})
+				if err != nil {
+					return nil, err
+				}
+				return result.Collect(ctx)
+			})
+		if err != nil {
+			return err
+		}
+		records := result.([]*neo4j.Record)
+		if len(records) == 0 {
+			return nil
+		}
+		for _, record := range records {
+			<-limiter.C
+			product := record.AsMap()
+			if err := job.reembedProduct(ctx, session, embedder, product); err != nil {
+				log.Printf("Error re-embedding product %v: %s", product["id"], err)
+				job.Failed++
+			} else {
+				job.Processed++
+			}
+			job.Cursor = product["element_id"].(string)
+		}
+		if err := job.save(ctx, session); err != nil {
+			return err
+		}
+	}
+}
+
+func (job *ReembedJob) reembedProduct(ctx context.Context, session neo4j.SessionWithContext, embedder Embedder, product map[string]any) error {
+	var fields types.WooCommerceProduct
+	fields.Name, _ = product["name"].(string)
+	fields.Description, _ = product["description"].(string)
+	fields.ShortDescription, _ = product["short_description"].(string)
+	categories, _ := product["categories"].([]any)
+	for _, value := range categories {
+		name, _ := value.(string)
+		fields.Categories = append(fields.Categories, types.WooCommerceTerm{Name: name})
+	}
+	tags, _ := product["tags"].([]any)
+	for _, value := range tags {
+		name, _ := value.(string)
+		fields.Tags = append(fields.Tags, types.WooCommerceTerm{Name: name})
+	}
+	attributes, _ := product["attributes"].([]any)
+	for _, value := range attributes {
+		attribute, _ := value.(map[string]any)
+		name, _ := attribute["name"].(string)
+		values, _ := attribute["options"].([]any)
+		var options []string
+		for _, option := range values {
+			if option, ok := option.(string); ok {
+				options = append(options, option)
+			}
+		}
+		fields.Attributes = append(fields.Attributes, types.WooCommerceAttribute{Name: name, Options: options})
+	}
+	// Admin products have no external_id and embed the fields SaveAdminProduct does
+	text := PrepareProductText(fields)
+	if product["external_id"] == nil {
+		text = PrepareProductTextFields(fields, adminEmbedTextFields())
+	}
+
+	chunks, _ := product["chunks"].([]any)
+	if len(chunks) == 0 {
+		// Products ingested before chunking get chunks for every write target
+		if err := StoreProductChunks(ctx, session, product["id"], text); err != nil {
+			return err
+		}
+	}
+
+	embeddings, err := EmbedWith(embedder, text)
+	if err != nil {
+		return err
+	}
+	var chunkProperties []map[string]any
+	for _, value := range chunks {
+		chunk := value.(map[string]any)
+		chunkText, _ := chunk["text"].(string)
+		chunkEmbeddings, err := EmbedWith(embedder, chunkText)
+		if err != nil {
+			return err
+		}
+		chunkProperties = append(chunkProperties, map[string]any{
+			"element_id": chunk["element_id"],
+			"properties": map[string]any{job.Target.Property: chunkEmbeddings},
+		})
+	}
+	query := `
+    MATCH (p:Product) WHERE elementId(p) = $element_id
+    SET p += $properties
+    WITH p
+    UNWIND $chunks AS chunk
+    MATCH (c:ProductChunk) WHERE elementId(c) = chunk.element_id
+    SET c += chunk.properties
+    `
+	params := map[string]any{
+		"element_id": product["element_id"],
+		"properties": map[string]any{job.Target.Property: embeddings},
+		"chunks":     chunkProperties,
+	}
+	_, err = session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return err
+}
+
+func (job *ReembedJob) save(ctx context.Context, session neo4j.SessionWithContext) error {
+	query := `
+    MATCH (j:ReembedJob {id: $id})
+    SET j.status = $status, j.cursor = $cursor, j.processed = $processed,
+        j.failed = $failed, j.total = $total, j.error = $error, j.updated_at = datetime()
+    `
+	params := map[string]any{
+		"id":        job.ID,
+		"status":    job.Status,
+		"cursor":    job.Cursor,
+		"processed": job.Processed,
+		"failed":    job.Failed,
+		"total":     job.Total,
+		"error":     job.Error,
+	}
+	_, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return err
+}
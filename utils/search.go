@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// ProductFulltextIndex is the fulltext index over product names, SKUs and
+// descriptions
+const ProductFulltextIndex = "product_fulltext"
+
+// Fusion methods combining the fulltext and vector rankings of a search
+const (
+	SearchFusionRRF      = "rrf"
+	SearchFusionWeighted = "weighted"
+)
+
+const (
+	defaultRRFK         = 60
+	defaultVectorWeight = 0.5
+	// searchCandidates is how many results each ranking contributes per
+	// requested product
+	searchCandidates = 4
+)
+
+// SearchSettings is how a site fuses its fulltext and vector rankings. RRFK
+// dampens the ranks of reciprocal rank fusion, VectorWeight weighs the
+// normalized vector score against the fulltext one
+type SearchSettings struct {
+	Fusion       string  `json:"fusion"`
+	RRFK         int     `json:"rrf_k"`
+	VectorWeight float64 `json:"vector_weight"`
+}
+
+// SearchResult is a product found by HybridSearch with the rank and score it
+// had in each ranking, 0 when it was missing from one
+type SearchResult struct {
+	Product       map[string]any `json:"product"`
+	Score         float64        `json:"score"`
+	FulltextRank  int            `json:"fulltext_rank"`
+	FulltextScore float64        `json:"fulltext_score"`
+	VectorRank    int            `json:"vector_rank"`
+	VectorScore   float64        `json:"vector_score"`
+}
+
+// DefaultSearchSettings fuses rankings with reciprocal rank fusion
+func DefaultSearchSettings() SearchSettings {
+	return SearchSettings{Fusion: SearchFusionRRF, RRFK: defaultRRFK, VectorWeight: defaultVectorWeight}
+}
+
+// Validate checks the fusion method and its parameters
+func (s SearchSettings) Validate() error {
+	if s.Fusion != SearchFusionRRF && s.Fusion != SearchFusionWeighted {
+		return fmt.Errorf("fusion must be %s or %s", SearchFusionRRF, SearchFusionWeighted)
+	}
+	if s.RRFK < 1 {
+		return fmt.Errorf("rrf_k must be positive")
+	}
+	if s.VectorWeight < 0 || s.VectorWeight > 1 {
+		return fmt.Errorf("vector_weight must be between 0 and 1")
+	}
+	return nil
+}
+
+// GetSiteSearchSettings returns the search settings of a site, defaulting
+// those it has not set
+func GetSiteSearchSettings(ctx context.Context, session neo4j.SessionWithContext, siteID string) (SearchSettings, error) {
+	query := `
+    MATCH (s:Site {id: $id})
+    RETURN s.search_fusion AS fusion, s.search_rrf_k AS rrf_k, s.search_vector_weight AS vector_weight
+    `
+	settings := DefaultSearchSettings()
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"id": siteID})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return settings, err
+	}
+	for _, record := range result.([]*neo4j.Record) {
+		if fusion, _ := record.Get("fusion"); fusion != nil {
+			settings.Fusion = fusion.(string)
+		}
+		if k, _ := record.Get("rrf_k"); k != nil {
+			settings.RRFK = int(k.(int64))
+		}
+		if weight, _ := record.Get("vector_weight"); weight != nil {
+			settings.VectorWeight = weight.(float64)
+		}
+	}
+	return settings, nil
+}
+
+// SetSiteSearchSettings stores validated search settings on a site
+func SetSiteSearchSettings(ctx context.Context, session neo4j.SessionWithContext, siteID string, settings SearchSettings) error {
+	query := `
+    MATCH (s:Site {id: $id})
+    SET s.search_fusion = $fusion, s.search_rrf_k = $rrf_k, s.search_vector_weight = $vector_weight
+    `
+	params := map[string]any{
+		"id":            siteID,
+		"fusion":        settings.Fusion,
+		"rrf_k":         settings.RRFK,
+		"vector_weight": settings.VectorWeight,
+	}
+	_, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return err
+}
+
+// luceneSpecial are the characters of the Lucene query syntax that are
+// escaped so typed text is searched as is
+const luceneSpecial = `+-&|!(){}[]^"~*?:\/`
+
+// FulltextQuery escapes text for a fulltext index query, matching any of its
+// terms. Exact names and SKUs score highest
+func FulltextQuery(text string) string {
+	var escaped strings.Builder
+	for _, r := range strings.TrimSpace(text) {
+		if strings.ContainsRune(luceneSpecial, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// searchResultCypher projects the `product` rows of a search
+const searchResultCypher = `
+    RETURN product {.id, .name, .sku, .price, .regular_price, .sale_price, .currency, .permalink,
+                    .featured_image, .stock_status, .on_sale} AS product, score
+    ORDER BY score DESC LIMIT $limit
+    `
+
+// HybridSearch ranks the active products of a site by the fulltext index and
+// by vector similarity to text, fusing both rankings with settings
+func HybridSearch(ctx context.Context, session neo4j.SessionWithContext, siteID string, text string, limit int, settings SearchSettings) ([]SearchResult, error) {
+	queryVector, target, err := GetQueryEmbeddings(ctx, session, text)
+	if err != nil {
+		return nil, err
+	}
+	fulltextQuery := `
+    CALL db.index.fulltext.queryNodes('` + ProductFulltextIndex + `', $text)
+    YIELD node AS product, score
+    WHERE coalesce(product.active, true) AND product.site_id = $site_id
+    ` + searchResultCypher
+	vectorQuery := ProductVectorSearchCypher(target) + `
+    WHERE coalesce(product.active, true) AND product.site_id = $site_id
+    ` + searchResultCypher
+	candidates := limit * searchCandidates
+	queries := []struct {
+		cypher string
+		params map[string]any
+	}{
+		{fulltextQuery, map[string]any{"site_id": siteID, "text": FulltextQuery(text), "limit": candidates}},
+		{vectorQuery, map[string]any{"site_id": siteID, "queryVector": queryVector, "limit": candidates}},
+	}
+	rankings, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			rankings := [][]*neo4j.Record{}
+			for _, query := range queries {
+				result, err := tx.Run(ctx, query.cypher, query.params)
+				if err != nil {
+					return nil, err
+				}
+				records, err := result.Collect(ctx)
+				if err != nil {
+					return nil, err
+				}
+				rankings = append(rankings, records)
+			}
+			return rankings, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	fulltext, vector := rankings.([][]*neo4j.Record)[0], rankings.([][]*neo4j.Record)[1]
+	return fuseRankings(fulltext, vector, limit, settings), nil
+}
+
+// fuseRankings merges the fulltext and vector rankings into the top limit
+// results. Weighted fusion scales each ranking's scores by its best score,
+// as fulltext scores are unbounded
+func fuseRankings(fulltext []*neo4j.Record, vector []*neo4j.Record, limit int, settings SearchSettings) []SearchResult {
+	results := map[string]*SearchResult{}
+	var order []string
+	rank := func(records []*neo4j.Record, set func(result *SearchResult, rank int, score float64)) float64 {
+		best := 0.0
+		for i, record := range records {
+			value, _ := record.Get("product")
+			score, _ := record.Get("score")
+			product := value.(map[string]any)
+			id := fmt.Sprint(product["id"])
+			result, ok := results[id]
+			if !ok {
+				FormatPrices(product)
+				result = &SearchResult{Product: product}
+				results[id] = result
+				order = append(order, id)
+			}
+			set(result, i+1, score.(float64))
+			if score.(float64) > best {
+				best = score.(float64)
+			}
+		}
+		return best
+	}
+	bestFulltext := rank(fulltext, func(result *SearchResult, rank int, score float64) {
+		result.FulltextRank, result.FulltextScore = rank, score
+	})
+	bestVector := rank(vector, func(result *SearchResult, rank int, score float64) {
+		result.VectorRank, result.VectorScore = rank, score
+	})
+
+	fused := []SearchResult{}
+	for _, id := range order {
+		result := results[id]
+		switch settings.Fusion {
+		case SearchFusionWeighted:
+			if bestVector > 0 {
+				result.Score += settings.VectorWeight * result.VectorScore / bestVector
+			}
+			if bestFulltext > 0 {
+				result.Score += (1 - settings.VectorWeight) * result.FulltextScore / bestFulltext
+			}
+		default:
+			if result.VectorRank > 0 {
+				result.Score += 1 / float64(settings.RRFK+result.VectorRank)
+			}
+			if result.FulltextRank > 0 {
+				result.Score += 1 / float64(settings.RRFK+result.FulltextRank)
+			}
+		}
+		fused = append(fused, *result)
+	}
+	sort.SliceStable(fused, func(i, j int) bool { return fused[i].Score > fused[j].Score })
+	if len(fused) > limit {
+		fused = fused[:limit]
+	}
+	return fused
+}
@@ -0,0 +1,372 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// Sync modes of a SyncRun
+const (
+	SyncFull        = "full"
+	SyncIncremental = "incremental"
+)
+
+// wooCommerceTimeLayout is the ISO 8601 layout modified_after accepts
+const wooCommerceTimeLayout = "2006-01-02T15:04:05"
+
+// SyncRun is one catalog synchronisation of a site, recorded on a SyncRun
+// node linked to the Site
+type SyncRun struct {
+	ID          string       `json:"id"`
+	SiteID      string       `json:"site_id"`
+	Mode        string       `json:"mode"`
+	Status      string       `json:"status"`
+	Since       string       `json:"since,omitempty"`
+	StartedAt   string       `json:"started_at"`
+	FinishedAt  string       `json:"finished_at,omitempty"`
+	Counts      UpsertCounts `json:"counts"`
+	Removed     int          `json:"removed"`
+	Error       string       `json:"error,omitempty"`
+	Reconciled  bool         `json:"reconciled"`
+	RemovalMode string       `json:"removal_mode"`
+}
+
+var (
+	runningSiteSyncs   = map[string]bool{}
+	runningSiteSyncsMu sync.Mutex
+)
+
+// SyncRemovalMode returns what happens to products gone from the store,
+// "deactivate" (default) or "delete", from SYNC_REMOVAL_MODE
+func SyncRemovalMode() string {
+	if os.Getenv("SYNC_REMOVAL_MODE") == "delete" {
+		return "delete"
+	}
+	return "deactivate"
+}
+
+// RunSiteSync synchronises the catalog of a site. An incremental run only
+// fetches products modified since the site's last_synced_at cursor, falling
+// back to a full run when there is none. Every run then reconciles products
+// removed from the store and records its outcome as a SyncRun. report, when
+// not nil, is told the outcome of every product
+func RunSiteSync(ctx context.Context, session neo4j.SessionWithContext, siteID string, mode string, report ProductReporter) (SyncRun, error) {
+	runningSiteSyncsMu.Lock()
+	if runningSiteSyncs[siteID] {
+		runningSiteSyncsMu.Unlock()
+		return SyncRun{}, fmt.Errorf("a sync of site %s is already running", siteID)
+	}
+	runningSiteSyncs[siteID] = true
+	runningSiteSyncsMu.Unlock()
+	defer func() {
+		runningSiteSyncsMu.Lock()
+		delete(runningSiteSyncs, siteID)
+		runningSiteSyncsMu.Unlock()
+	}()
+
+	client, err := GetSiteWooCommerceClient(ctx, session, siteID)
+	if err != nil {
+		return SyncRun{}, err
+	}
+	since, err := siteSyncCursor(ctx, session, siteID)
+	if err != nil {
+		return SyncRun{}, err
+	}
+	if since == "" {
+		mode = SyncFull
+	}
+	// The cursor moves to when this run started, so products modified while
+	// it runs are fetched again next time
+	startedAt := time.Now().UTC()
+	run := SyncRun{
+		ID:          NewID(),
+		SiteID:      siteID,
+		Mode:        mode,
+		Status:      "running",
+		StartedAt:   startedAt.Format(time.RFC3339),
+		RemovalMode: SyncRemovalMode(),
+	}
+	if mode == SyncIncremental {
+		run.Since = since
+	}
+	if err := saveSyncRun(ctx, session, run); err != nil {
+		return run, err
+	}
+
+	params := url.Values{}
+	if mode == SyncIncremental {
+		params.Set("modified_after", since)
+		params.Set("dates_are_gmt", "true")
+	}
+	run.Counts, err = SyncSiteProducts(ctx, session, siteID, client, params, report)
+	if err == nil {
+		run.Removed, run.Reconciled, err = reconcileSiteProducts(ctx, session, siteID, client)
+	}
+
+	run.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	run.Status = "succeeded"
+	if err != nil {
+		run.Status = "failed"
+		run.Error = err.Error()
+	}
+	if saveErr := saveSyncRun(ctx, session, run); saveErr != nil {
+		return run, saveErr
+	}
+	if err != nil {
+		return run, err
+	}
+	return run, setSiteSyncCursor(ctx, session, siteID, startedAt.Format(wooCommerceTimeLayout))
+}
+
+// reconcileSiteProducts lists every product id in the store and deactivates,
+// or deletes, the site's products that are no longer listed. Products it
+// deactivated that are listed again are reactivated; those deleted by an admin
+// or a webhook are left deleted. An empty listing is treated as a
+// misconfigured store and skipped rather than removing the whole catalog
+func reconcileSiteProducts(ctx context.Context, session neo4j.SessionWithContext, siteID string, client *WooCommerceClient) (int, bool, error) {
+	var ids []int
+	params := url.Values{"_fields": {"id"}}
+	err := client.EachProductPage(ctx, params, func(page int, products []types.WooCommerceProduct) error {
+		for _, product := range products {
+			ids = append(ids, product.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if len(ids) == 0 {
+		log.Printf("Store of site %s listed no products, skipping removal reconciliation", siteID)
+		return 0, false, nil
+	}
+
+	query := `
+    MATCH (p:Product {site_id: $site_id})
+    WHERE p.external_id IS NOT NULL AND p.external_id IN $ids AND p.active = false AND p.deleted_by = $deleted_by
+    SET p.active = true
+    REMOVE p.deleted_at, p.deleted_by
+    WITH count(*) AS reactivated
+    MATCH (p:Product {site_id: $site_id})
+    WHERE p.external_id IS NOT NULL AND NOT p.external_id IN $ids AND coalesce(p.active, true)
+    SET p.active = false, p.deleted_at = datetime(), p.deleted_by = $deleted_by
+    RETURN count(p) AS removed
+    `
+	if SyncRemovalMode() == "delete" {
+		query = `
+    MATCH (p:Product {site_id: $site_id})
+    WHERE p.external_id IS NOT NULL AND NOT p.external_id IN $ids
+    OPTIONAL MATCH (p)-[:HAS_CHUNK|HAS_VARIATION]->(c:ProductChunk|Variation)
+    DETACH DELETE c
+    WITH collect(DISTINCT p) AS products
+    FOREACH (p IN products | DETACH DELETE p)
+    RETURN size(products) AS removed
+    `
+	}
+	result, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"site_id": siteID, "ids": ids, "deleted_by": ProductSourceSync})
+			if err != nil {
+				return nil, err
+			}
+			return result.Single(ctx)
+		})
+	if err != nil {
+		return 0, false, err
+	}
+	removed, _ := result.(*neo4j.Record).Get("removed")
+	return int(removed.(int64)), true, nil
+}
+
+func siteSyncCursor(ctx context.Context, session neo4j.SessionWithContext, siteID string) (string, error) {
+	query := `MATCH (s:Site {id: $id}) RETURN s.last_synced_at AS cursor`
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"id": siteID})
+			if err != nil {
+				return nil, err
+			}
+			return result.Single(ctx)
+		})
+	if err != nil {
+		return "", err
+	}
+	cursor, _ := result.(*neo4j.Record).Get("cursor")
+	value, _ := cursor.(string)
+	return value, nil
+}
+
+func setSiteSyncCursor(ctx context.Context, session neo4j.SessionWithContext, siteID string, cursor string) error {
+	query := `MATCH (s:Site {id: $id}) SET s.last_synced_at = $cursor`
+	_, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"id": siteID, "cursor": cursor})
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return err
+}
+
+func saveSyncRun(ctx context.Context, session neo4j.SessionWithContext, run SyncRun) error {
+	query := `
+    MATCH (s:Site {id: $site_id})
+    MERGE (r:SyncRun {id: $id})
+    ON CREATE SET r.site_id = $site_id, r.mode = $mode, r.since = $since,
+        r.started_at = datetime($started_at), r.removal_mode = $removal_mode
+    MERGE (r)-[:SYNC_OF]->(s)
+    SET r.status = $status, r.error = $error,
+        r.created = $counts.created, r.updated = $counts.updated,
+        r.unchanged = $counts.unchanged, r.failed = $counts.failed,
+        r.removed = $removed, r.reconciled = $reconciled,
+        r.finished_at = CASE WHEN $finished_at = "" THEN null ELSE datetime($finished_at) END
+    `
+	params := map[string]any{
+		"id":           run.ID,
+		"site_id":      run.SiteID,
+		"mode":         run.Mode,
+		"since":        run.Since,
+		"status":       run.Status,
+		"error":        run.Error,
+		"started_at":   run.StartedAt,
+		"finished_at":  run.FinishedAt,
+		"removal_mode": run.RemovalMode,
+		"removed":      run.Removed,
+		"reconciled":   run.Reconciled,
+		"counts": map[string]any{
+			"created":   run.Counts.Created,
+			"updated":   run.Counts.Updated,
+			"unchanged": run.Counts.Unchanged,
+			"failed":    run.Counts.Failed,
+		},
+	}
+	_, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume(ctx)
+		})
+	return err
+}
+
+// GetSyncHistory returns the latest limit sync runs of a site, newest first
+func GetSyncHistory(ctx context.Context, session neo4j.SessionWithContext, siteID string, limit int) ([]SyncRun, error) {
+	query := `
+    MATCH (r:SyncRun {site_id: $site_id})
+    RETURN r {.*, started_at: toString(r.started_at), finished_at: toString(r.finished_at)} AS run
+    ORDER BY r.started_at DESC LIMIT $limit
+    `
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"site_id": siteID, "limit": limit})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	runs := []SyncRun{}
+	for _, record := range result.([]*neo4j.Record) {
+		value, _ := record.Get("run")
+		values := value.(map[string]any)
+		text := func(key string) string {
+			value, _ := values[key].(string)
+			return value
+		}
+		number := func(key string) int {
+			value, _ := values[key].(int64)
+			return int(value)
+		}
+		reconciled, _ := values["reconciled"].(bool)
+		runs = append(runs, SyncRun{
+			ID:          text("id"),
+			SiteID:      text("site_id"),
+			Mode:        text("mode"),
+			Status:      text("status"),
+			Since:       text("since"),
+			StartedAt:   text("started_at"),
+			FinishedAt:  text("finished_at"),
+			Error:       text("error"),
+			RemovalMode: text("removal_mode"),
+			Removed:     number("removed"),
+			Reconciled:  reconciled,
+			Counts: UpsertCounts{
+				Created:   number("created"),
+				Updated:   number("updated"),
+				Unchanged: number("unchanged"),
+				Failed:    number("failed"),
+			},
+		})
+	}
+	return runs, nil
+}
+
+// StartSyncScheduler queues an incremental sync of every site with a
+// WooCommerce store each SYNC_INTERVAL (e.g. "15m"). It does nothing when
+// SYNC_INTERVAL is unset
+func StartSyncScheduler(ctx context.Context) {
+	interval, err := time.ParseDuration(os.Getenv("SYNC_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return
+	}
+	log.Printf("Syncing WooCommerce catalogs every %s", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				syncAllSites(ctx)
+			}
+		}
+	}()
+}
+
+func syncAllSites(ctx context.Context) {
+	driver, err := neo4j.NewDriverWithContext(os.Getenv("NEO4J_URI"), neo4j.BasicAuth(os.Getenv("NEO4J_USERNAME"), os.Getenv("NEO4J_PASSWORD"), ""))
+	if err != nil {
+		log.Printf("Scheduled sync could not connect to Neo4j: %v", err)
+		return
+	}
+	defer driver.Close(ctx)
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: os.Getenv("NEO4J_DB")})
+	defer session.Close(ctx)
+
+	query := `MATCH (s:Site) WHERE s.woocommerce_url IS NOT NULL AND s.woocommerce_url <> "" RETURN s.id AS id`
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, nil)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		log.Printf("Scheduled sync could not list sites: %v", err)
+		return
+	}
+	for _, record := range result.([]*neo4j.Record) {
+		id, _ := record.Get("id")
+		siteID := fmt.Sprint(id)
+		job, _, err := SubmitIngestionJob(ctx, session, siteID, SyncIncremental)
+		if err != nil {
+			log.Printf("Scheduled sync of site %s could not be queued: %v", siteID, err)
+			continue
+		}
+		log.Printf("Scheduled sync of site %s as job %s", siteID, job.ID)
+	}
+}
@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	xhtml "golang.org/x/net/html"
+)
+
+// defaultEmbedTextFields keeps the text that was embedded before the
+// preparation pipeline existed: the description followed by the short description
+const defaultEmbedTextFields = "description,short_description"
+
+var (
+	shortcodePattern = regexp.MustCompile(`\[/?[A-Za-z][\w-]*(\s[^\[\]]*)?/?\]`)
+	// boilerplatePatterns match storefront phrases that carry no product meaning
+	boilerplatePatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)\badd to cart\b`),
+		regexp.MustCompile(`(?i)\bread more\b`),
+		regexp.MustCompile(`(?i)\bcontinue reading\b`),
+		regexp.MustCompile(`(?i)\bclick here\b`),
+	}
+	blockElements = map[string]bool{
+		"br": true, "p": true, "div": true, "li": true, "ul": true, "ol": true,
+		"tr": true, "td": true, "th": true, "table": true, "section": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	}
+
+	// configuredBoilerplatePatterns match the EMBED_TEXT_BOILERPLATE phrases,
+	// compiled on first use since the environment is loaded after init
+	configuredBoilerplatePatterns     []*regexp.Regexp
+	configuredBoilerplatePatternsOnce sync.Once
+)
+
+// HTMLToText returns the visible text of an HTML fragment with entities decoded,
+// dropping script and style contents and separating block elements with spaces
+func HTMLToText(fragment string) string {
+	var text strings.Builder
+	tokenizer := xhtml.NewTokenizer(strings.NewReader(fragment))
+	skip := 0
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case xhtml.ErrorToken:
+			if tokenizer.Err() != io.EOF {
+				return fragment
+			}
+			return text.String()
+		case xhtml.TextToken:
+			if skip == 0 {
+				text.Write(tokenizer.Text())
+			}
+		case xhtml.StartTagToken, xhtml.EndTagToken, xhtml.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+			if tag == "script" || tag == "style" {
+				if tokenType == xhtml.StartTagToken {
+					skip++
+				} else if skip > 0 {
+					skip--
+				}
+			}
+			if blockElements[tag] {
+				text.WriteString(" ")
+			}
+		}
+	}
+}
+
+// RemoveShortcodes strips WordPress page-builder shortcodes such as
+// [vc_row] or [caption id="1"] while keeping the text they wrap
+func RemoveShortcodes(text string) string {
+	return shortcodePattern.ReplaceAllString(text, " ")
+}
+
+// RemoveBoilerplate strips storefront boilerplate phrases, extended by the
+// pipe separated EMBED_TEXT_BOILERPLATE setting
+func RemoveBoilerplate(text string) string {
+	configuredBoilerplatePatternsOnce.Do(func() {
+		for _, phrase := range strings.Split(os.Getenv("EMBED_TEXT_BOILERPLATE"), "|") {
+			if phrase = strings.TrimSpace(phrase); phrase != "" {
+				configuredBoilerplatePatterns = append(configuredBoilerplatePatterns, regexp.MustCompile(`(?i)`+regexp.QuoteMeta(phrase)))
+			}
+		}
+	})
+	for _, pattern := range boilerplatePatterns {
+		text = pattern.ReplaceAllString(text, " ")
+	}
+	for _, pattern := range configuredBoilerplatePatterns {
+		text = pattern.ReplaceAllString(text, " ")
+	}
+	return text
+}
+
+// CleanText converts WooCommerce HTML to plain text ready for embedding.
+// HTMLToText decodes entities once, so text that is meant to read "&lt;"
+// keeps doing so
+func CleanText(fragment string) string {
+	text := HTMLToText(fragment)
+	text = RemoveShortcodes(text)
+	text = RemoveBoilerplate(text)
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// EmbedTextFields returns the product fields included in embedded text, in
+// order, from the comma separated EMBED_TEXT_FIELDS setting. Supported fields
+// are name, short_description, description, categories, tags and attributes
+func EmbedTextFields() []string {
+	setting := os.Getenv("EMBED_TEXT_FIELDS")
+	if setting == "" {
+		setting = defaultEmbedTextFields
+	}
+	var fields []string
+	for _, field := range strings.Split(setting, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// PrepareProductText builds the cleaned text of a WooCommerce product that
+// every ingestion path embeds
+func PrepareProductText(product types.WooCommerceProduct) string {
+	return PrepareProductTextFields(product, EmbedTextFields())
+}
+
+// PrepareProductTextFields builds the cleaned text of a product from the given fields
+func PrepareProductTextFields(product types.WooCommerceProduct, fields []string) string {
+	var parts []string
+	for _, field := range fields {
+		var part string
+		switch field {
+		case "name":
+			part = CleanText(product.Name)
+		case "description":
+			part = CleanText(product.Description)
+		case "short_description":
+			part = CleanText(product.ShortDescription)
+		case "categories":
+			var names []string
+			for _, category := range product.Categories {
+				names = append(names, CleanText(category.Name))
+			}
+			if len(names) > 0 {
+				part = "Categories: " + strings.Join(names, ", ")
+			}
+		case "tags":
+			var names []string
+			for _, tag := range product.Tags {
+				names = append(names, CleanText(tag.Name))
+			}
+			if len(names) > 0 {
+				part = "Tags: " + strings.Join(names, ", ")
+			}
+		case "attributes":
+			var attributes []string
+			for _, attribute := range product.Attributes {
+				if len(attribute.Options) > 0 {
+					attributes = append(attributes, CleanText(attribute.Name)+": "+CleanText(strings.Join(attribute.Options, ", ")))
+				}
+			}
+			part = strings.Join(attributes, ". ")
+		}
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// Sources of a product change recorded on its ProductVersion
+const (
+	ProductSourceSync    = "sync"
+	ProductSourceWebhook = "webhook"
+	ProductSourceAdmin   = "admin"
+)
+
+// ProductVersion is a change to a product's properties, keeping the values
+// it replaced and a snapshot of the properties it left
+type ProductVersion struct {
+	ID               string         `json:"id"`
+	ProductID        string         `json:"product_id"`
+	Version          int64          `json:"version"`
+	Source           string         `json:"source"`
+	ChangedFields    []string       `json:"changed_fields"`
+	Previous         map[string]any `json:"previous"`
+	Snapshot         map[string]any `json:"snapshot,omitempty"`
+	EmbeddingModel   string         `json:"embedding_model"`
+	EmbeddingVersion string         `json:"embedding_version"`
+	CreatedAt        string         `json:"created_at"`
+}
+
+// FieldChange is the value of a field in two versions of a product
+type FieldChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// productVersion returns the parameters of the ProductVersion recording the
+// change from stored, nil for a new product, to properties, or nil when no
+// property changed. properties must not hold embeddings yet
+func productVersion(source string, stored map[string]any, properties map[string]any) map[string]any {
+	changed := []string{}
+	previous := map[string]any{}
+	for key, value := range properties {
+		if stored == nil {
+			changed = append(changed, key)
+			continue
+		}
+		// Printing compares lists read back from Neo4j with new ones
+		if fmt.Sprint(stored[key]) != fmt.Sprint(value) {
+			changed = append(changed, key)
+			previous[key] = stored[key]
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	sort.Strings(changed)
+	snapshot, _ := json.Marshal(properties)
+	replaced, _ := json.Marshal(previous)
+	return map[string]any{
+		"id":             NewID(),
+		"source":         source,
+		"changed_fields": changed,
+		"snapshot":       string(snapshot),
+		"previous":       string(replaced),
+	}
+}
+
+// productVersionCypher creates the ProductVersion of `version` for `p`, whose
+// properties have just been SET. It bumps p.version, so it must run once per change
+const productVersionCypher = `
+    SET p.version = coalesce(p.version, 0) + 1
+    CREATE (p)-[:HAS_VERSION]->(:ProductVersion {
+        id: version.id, product_id: p.id, version: p.version, source: version.source,
+        changed_fields: version.changed_fields, snapshot: version.snapshot, previous: version.previous,
+        embedding_model: p.embedding_model, embedding_version: p.embedding_version,
+        created_at: datetime()
+    })
+    `
+
+// GetProductVersions lists the versions of a product, newest first, without
+// their snapshots
+func GetProductVersions(ctx context.Context, session neo4j.SessionWithContext, productID string, limit int) ([]ProductVersion, error) {
+	query := `
+    MATCH (:Product {id: $product_id})-[:HAS_VERSION]->(v:ProductVersion)
+    RETURN v {.*, snapshot: null, created_at: toString(v.created_at)} AS version
+    ORDER BY v.version DESC LIMIT $limit
+    `
+	return readProductVersions(ctx, session, query, map[string]any{"product_id": productID, "limit": limit})
+}
+
+// DiffProductVersions returns the fields that differ between two versions of
+// a product, with their value in each. found is false when either is missing
+func DiffProductVersions(ctx context.Context, session neo4j.SessionWithContext, productID string, from int, to int) (map[string]FieldChange, bool, error) {
+	query := `
+    MATCH (:Product {id: $product_id})-[:HAS_VERSION]->(v:ProductVersion)
+    WHERE v.version IN [$from, $to]
+    RETURN v {.*, created_at: toString(v.created_at)} AS version
+    `
+	versions, err := readProductVersions(ctx, session, query, map[string]any{"product_id": productID, "from": from, "to": to})
+	if err != nil {
+		return nil, false, err
+	}
+	snapshots := map[int64]map[string]any{}
+	for _, version := range versions {
+		snapshots[version.Version] = version.Snapshot
+	}
+	before, foundFrom := snapshots[int64(from)]
+	after, foundTo := snapshots[int64(to)]
+	if !foundFrom || !foundTo {
+		return nil, false, nil
+	}
+	diff := map[string]FieldChange{}
+	for key, value := range after {
+		if !reflect.DeepEqual(before[key], value) {
+			diff[key] = FieldChange{From: before[key], To: value}
+		}
+	}
+	for key, value := range before {
+		if _, ok := after[key]; !ok {
+			diff[key] = FieldChange{From: value}
+		}
+	}
+	return diff, true, nil
+}
+
+func readProductVersions(ctx context.Context, session neo4j.SessionWithContext, query string, params map[string]any) ([]ProductVersion, error) {
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	versions := []ProductVersion{}
+	for _, record := range result.([]*neo4j.Record) {
+		value, _ := record.Get("version")
+		properties := value.(map[string]any)
+		version := ProductVersion{Previous: map[string]any{}}
+		version.ID, _ = properties["id"].(string)
+		version.ProductID, _ = properties["product_id"].(string)
+		version.Version, _ = properties["version"].(int64)
+		version.Source, _ = properties["source"].(string)
+		version.EmbeddingModel, _ = properties["embedding_model"].(string)
+		version.EmbeddingVersion, _ = properties["embedding_version"].(string)
+		version.CreatedAt, _ = properties["created_at"].(string)
+		if fields, ok := properties["changed_fields"].([]any); ok {
+			for _, field := range fields {
+				version.ChangedFields = append(version.ChangedFields, fmt.Sprint(field))
+			}
+		}
+		if previous, ok := properties["previous"].(string); ok {
+			json.Unmarshal([]byte(previous), &version.Previous)
+		}
+		if snapshot, ok := properties["snapshot"].(string); ok {
+			json.Unmarshal([]byte(snapshot), &version.Snapshot)
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// WebhookSignature returns the X-WC-Webhook-Signature WooCommerce sends with
+// body, the base64 HMAC-SHA256 of the body keyed with the webhook secret
+func WebhookSignature(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// GetSiteIDByWebhookSignature returns the id of the Site whose secret, set as
+// the secret of its WooCommerce webhooks, signed body
+func GetSiteIDByWebhookSignature(ctx context.Context, session neo4j.SessionWithContext, body []byte, signature string) (string, error) {
+	if signature == "" {
+		return "", fmt.Errorf("missing webhook signature")
+	}
+	query := `MATCH (s:Site) WHERE s.secret IS NOT NULL RETURN s.id AS id, s.secret AS secret`
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, nil)
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return "", err
+	}
+	for _, record := range result.([]*neo4j.Record) {
+		id, _ := record.Get("id")
+		secret, _ := record.Get("secret")
+		expected := WebhookSignature(body, fmt.Sprint(secret))
+		if hmac.Equal([]byte(expected), []byte(signature)) {
+			return fmt.Sprint(id), nil
+		}
+	}
+	return "", fmt.Errorf("invalid webhook signature")
+}
+
+// RemoveWooCommerceProduct soft deletes a product deleted from a site's store,
+// returning whether it was found. It keeps its purchase history and can be
+// restored until PurgeDeletedProducts removes it. deleted_by keeps whoever
+// deleted it first
+func RemoveWooCommerceProduct(ctx context.Context, session neo4j.SessionWithContext, siteID string, externalID int) (bool, error) {
+	query := `
+    MATCH (p:Product {site_id: $site_id, external_id: $external_id})
+    SET p.active = false, p.deleted_by = CASE WHEN p.deleted_at IS NULL THEN "` + ProductSourceWebhook + `" ELSE p.deleted_by END,
+        p.deleted_at = coalesce(p.deleted_at, datetime())
+    RETURN count(p) AS removed
+    `
+	return writeProductCount(ctx, session, query, siteID, externalID)
+}
+
+// RestoreWooCommerceProduct undoes the soft delete of a product restored in a
+// site's store
+func RestoreWooCommerceProduct(ctx context.Context, session neo4j.SessionWithContext, siteID string, externalID int) (bool, error) {
+	query := `
+    MATCH (p:Product {site_id: $site_id, external_id: $external_id})
+    WHERE p.active = false
+    SET p.active = true
+    REMOVE p.deleted_at, p.deleted_by
+    RETURN count(p) AS restored
+    `
+	return writeProductCount(ctx, session, query, siteID, externalID)
+}
+
+func writeProductCount(ctx context.Context, session neo4j.SessionWithContext, query string, siteID string, externalID int) (bool, error) {
+	params := map[string]any{"site_id": siteID, "external_id": externalID}
+	result, err := session.ExecuteWrite(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			record, err := result.Single(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return record.Values[0], nil
+		})
+	if err != nil {
+		return false, err
+	}
+	return result.(int64) > 0, nil
+}
@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Huvinesh-Rajendran-12/neo4j-go-api/types"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+const (
+	wooCommercePerPage    = 100
+	defaultMaxRetries     = 5
+	maxRetryBackoff       = 30 * time.Second
+	wooCommerceAPIVersion = "/wp-json/wc/v3"
+)
+
+// WooCommerceClient reads a store through the WooCommerce REST API
+type WooCommerceClient struct {
+	BaseURL        string
+	ConsumerKey    string
+	ConsumerSecret string
+	HTTPClient     *http.Client
+	MaxRetries     int
+}
+
+// NewWooCommerceClient returns a client for the store at baseURL, retrying
+// rate limited and failed requests up to WOOCOMMERCE_MAX_RETRIES times
+func NewWooCommerceClient(baseURL string, consumerKey string, consumerSecret string) *WooCommerceClient {
+	maxRetries := defaultMaxRetries
+	if value, err := strconv.Atoi(os.Getenv("WOOCOMMERCE_MAX_RETRIES")); err == nil && value >= 0 {
+		maxRetries = value
+	}
+	return &WooCommerceClient{
+		BaseURL:        baseURL,
+		ConsumerKey:    consumerKey,
+		ConsumerSecret: consumerSecret,
+		HTTPClient:     &http.Client{Timeout: 60 * time.Second},
+		MaxRetries:     maxRetries,
+	}
+}
+
+// apiRoot returns the REST API root of the store. BaseURL may be the store
+// URL or, as WOOCOMMERCE_PRODUCT_API used to be, the products endpoint
+func (wc *WooCommerceClient) apiRoot() string {
+	root := strings.TrimSuffix(wc.BaseURL, "/")
+	root = strings.TrimSuffix(root, "/products")
+	if !strings.Contains(root, "/wp-json/") {
+		root += wooCommerceAPIVersion
+	}
+	return root
+}
+
+// EachProductPage requests every page of products matching params, following
+// X-WP-TotalPages, and calls fn with the products of each page in order
+func (wc *WooCommerceClient) EachProductPage(ctx context.Context, params url.Values, fn func(page int, products []types.WooCommerceProduct) error) error {
+	totalPages := 1
+	for page := 1; page <= totalPages; page++ {
+		query := url.Values{}
+		for key, values := range params {
+			query[key] = values
+		}
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(wooCommercePerPage))
+
+		var products []types.WooCommerceProduct
+		header, err := wc.get(ctx, "/products", query, &products)
+		if err != nil {
+			return fmt.Errorf("page %d: %v", page, err)
+		}
+		if value, err := strconv.Atoi(header.Get("X-WP-TotalPages")); err == nil {
+			totalPages = value
+		} else if len(products) == wooCommercePerPage {
+			// Without the header keep paging until a short page
+			totalPages = page + 1
+		}
+		if err := fn(page, products); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProductVariations requests every page of the variations of a variable product
+func (wc *WooCommerceClient) ProductVariations(ctx context.Context, productID int) ([]types.WooCommerceVariation, error) {
+	variations := []types.WooCommerceVariation{}
+	totalPages := 1
+	for page := 1; page <= totalPages; page++ {
+		query := url.Values{}
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(wooCommercePerPage))
+		var pageVariations []types.WooCommerceVariation
+		header, err := wc.get(ctx, fmt.Sprintf("/products/%d/variations", productID), query, &pageVariations)
+		if err != nil {
+			return nil, fmt.Errorf("variations of product %d: %v", productID, err)
+		}
+		if value, err := strconv.Atoi(header.Get("X-WP-TotalPages")); err == nil {
+			totalPages = value
+		} else if len(pageVariations) == wooCommercePerPage {
+			totalPages = page + 1
+		}
+		variations = append(variations, pageVariations...)
+	}
+	return variations, nil
+}
+
+// AttachVariations fetches the variations of the variable products among
+// products. A product whose variations fail to load keeps nil Variations, so
+// the variations stored for it are left as they are
+func (wc *WooCommerceClient) AttachVariations(ctx context.Context, products []types.WooCommerceProduct) {
+	for i, product := range products {
+		if product.Type != "variable" {
+			continue
+		}
+		variations, err := wc.ProductVariations(ctx, product.ID)
+		if err != nil {
+			log.Printf("Error fetching variations: %s", err.Error())
+			continue
+		}
+		products[i].Variations = variations
+	}
+}
+
+// get requests path below the API root and decodes the JSON body into out,
+// retrying 429 and 5xx responses after Retry-After or an exponential backoff.
+// The credentials go in the Authorization header so that the URLs in logged
+// and returned errors don't carry them
+func (wc *WooCommerceClient) get(ctx context.Context, path string, query url.Values, out any) (http.Header, error) {
+	endpoint, err := url.Parse(wc.apiRoot() + path)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.RawQuery = query.Encode()
+
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		request.SetBasicAuth(wc.ConsumerKey, wc.ConsumerSecret)
+		response, err := wc.HTTPClient.Do(request)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			wait = retryBackoff(attempt, "")
+		case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+			wait = retryBackoff(attempt, response.Header.Get("Retry-After"))
+			response.Body.Close()
+			err = fmt.Errorf("WooCommerce responded %s", response.Status)
+		case response.StatusCode != http.StatusOK:
+			response.Body.Close()
+			return nil, fmt.Errorf("WooCommerce responded %s", response.Status)
+		default:
+			defer response.Body.Close()
+			if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+				return nil, fmt.Errorf("failed to decode WooCommerce response: %v", err)
+			}
+			return response.Header, nil
+		}
+		if attempt >= wc.MaxRetries {
+			return nil, err
+		}
+		log.Printf("WooCommerce request failed (%v), retrying in %s", err, wait)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryBackoff honours a Retry-After header given in seconds or as an HTTP
+// date, and otherwise doubles from one second per attempt
+func retryBackoff(attempt int, retryAfter string) time.Duration {
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	wait := time.Second << attempt
+	if wait <= 0 || wait > maxRetryBackoff {
+		wait = maxRetryBackoff
+	}
+	return wait
+}
+
+// GetSiteWooCommerceClient returns a client using the WooCommerce URL and REST
+// credentials stored on the Site
+func GetSiteWooCommerceClient(ctx context.Context, session neo4j.SessionWithContext, siteID string) (*WooCommerceClient, error) {
+	query := `
+    MATCH (s:Site {id: $id})
+    RETURN s.woocommerce_url AS url, s.consumer_key AS consumer_key, s.consumer_secret AS consumer_secret
+    `
+	result, err := session.ExecuteRead(ctx,
+		func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, query, map[string]any{"id": siteID})
+			if err != nil {
+				return nil, err
+			}
+			return result.Collect(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	records := result.([]*neo4j.Record)
+	if len(records) == 0 {
+		return nil, fmt.Errorf("site not found")
+	}
+	field := func(key string) string {
+		value, _ := records[0].Get(key)
+		text, _ := value.(string)
+		return text
+	}
+	baseURL := field("url")
+	if baseURL == "" {
+		return nil, fmt.Errorf("site has no WooCommerce URL")
+	}
+	return NewWooCommerceClient(baseURL, field("consumer_key"), field("consumer_secret")), nil
+}
+
+// ProductReporter is told the outcome of each product upserted by a sync, or
+// the error that made it fail
+type ProductReporter func(externalID int, outcome string, err error)
+
+// SyncSiteProducts upserts every product of the site's catalog matching
+// params through the ingestion pipeline, passing each outcome to report when
+// it is not nil
+func SyncSiteProducts(ctx context.Context, session neo4j.SessionWithContext, siteID string, client *WooCommerceClient, params url.Values, report ProductReporter) (UpsertCounts, error) {
+	pipeline, err := NewIngestPipeline(ctx, session)
+	if err != nil {
+		return UpsertCounts{}, err
+	}
+	pipeline.Report = report
+	if pipeline.Currency, err = GetSiteCurrency(ctx, session, siteID); err != nil {
+		return UpsertCounts{}, err
+	}
+	return pipeline.Run(ctx, siteID, func(add func(products []types.WooCommerceProduct) error) error {
+		return client.EachProductPage(ctx, params, func(page int, products []types.WooCommerceProduct) error {
+			log.Printf("Syncing page %d of site %s", page, siteID)
+			client.AttachVariations(ctx, products)
+			return add(products)
+		})
+	})
+}